@@ -8,10 +8,12 @@ import (
 )
 
 // Btree Node Layout
-// group:   | header          | pointers       | offsets        | packed keys-values
-// data:    | type   | nkeys  | pointers       | offsets        | packed keys-values
-// size:    | 2B     | 2B     | nkeys * 8B     | nkeys*2B       | nkeys * (key_len + value_len + key + value)
-// go type: | uint16 | uint16 | nkeys * uint64 | nkeys * uint16 | nkeys * (uint16 + uint16 + key + value)
+// group:   | header                     | pointers       | offsets        | packed keys-values
+// data:    | type   | nkeys  | checksum | pointers       | offsets        | packed keys-values
+// size:    | 2B     | 2B     | 4B       | nkeys * 8B     | nkeys*2B       | nkeys * (key_len + value_len + key + value)
+// go type: | uint16 | uint16 | uint32   | nkeys * uint64 | nkeys * uint16 | nkeys * (uint16 + uint16 + key + value)
+//
+// The checksum is set by the pager when the node is flushed, see Page.sealed.
 //
 // Packed keys-values layout
 // | key_len | value_len | key | value
@@ -26,7 +28,7 @@ const (
 	BTREE_INTERNAL_NODE uint16 = 1
 	BTREE_LEAF_NODE     uint16 = 2
 
-	BTREE_NODE_HEADER_SIZE = 4
+	BTREE_NODE_HEADER_SIZE = 8
 	BTREE_POINTER_SIZE     = 8
 	BTREE_OFFSET_SIZE      = 2
 	BTREE_KEY_LEN_SIZE     = 2
@@ -83,14 +85,64 @@ func (tree *Btree) Delete(key []byte) bool {
 		return false
 	}
 	tree.pager.free(tree.root)
-	if newRoot.getNkeys() == BTREE_INTERNAL_NODE && newRoot.getNkeys() == 1 {
-		tree.root = newRoot.getPointer(0)
-	} else {
-		tree.root = tree.pager.allocate(newRoot.asPage())
-	}
+	tree.setRoot(*newRoot)
 	return true
 }
 
+// DeleteRange deletes the keys from start, included, to end, excluded. A nil end ranges to the last key.
+// The subtrees whose keys are all within the range are freed without being rewritten, the values of their leaves
+// are still passed to freeVal before the pages are freed so that what they point to can be freed too.
+// It returns the number of keys deleted.
+func (tree *Btree) DeleteRange(start, end []byte, freeVal func(val []byte)) int {
+	if tree.root == 0 || (end != nil && bytes.Compare(start, end) >= 0) {
+		return 0
+	}
+	newRoot, n := treeDeleteRange(tree, tree.pager.load(tree.root).asBtreeNode(), start, end, nil, freeVal)
+	if newRoot == nil {
+		return 0
+	}
+	tree.pager.free(tree.root)
+	tree.setRoot(*newRoot)
+	return n
+}
+
+// setRoot allocates the new root after a deletion, splitting it if it has grown as the keys of its children
+// changed, or shrinking the tree while the root has a single child.
+// The tree is empty once the root is a leaf holding only the dummy key.
+func (tree *Btree) setRoot(root BtreeNode) {
+	nsplit, splitted := nodeSplit(root)
+	if nsplit > 1 {
+		root := newBtreeNode()
+		root.setHeader(BTREE_INTERNAL_NODE, nsplit)
+		for i, child := range splitted[:nsplit] {
+			nodeWriteAt(root, uint16(i), tree.pager.allocate(child.asPage()), child.getKey(0), nil)
+		}
+		tree.root = tree.pager.allocate(root.asPage())
+		return
+	}
+	// ptr is the page of the node becoming the root while the root has a single child, which is already allocated.
+	root, ptr := splitted[0], uint64(0)
+	for root.getNodeType() == BTREE_INTERNAL_NODE && root.getNkeys() == 1 {
+		if ptr != 0 {
+			tree.pager.free(ptr)
+		}
+		ptr = root.getPointer(0)
+		root = tree.pager.load(ptr).asBtreeNode()
+	}
+	switch {
+	case root.getNodeType() == BTREE_LEAF_NODE && root.getNkeys() == 1:
+		// only the dummy key is left.
+		if ptr != 0 {
+			tree.pager.free(ptr)
+		}
+		tree.root = 0
+	case ptr != 0:
+		tree.root = ptr
+	default:
+		tree.root = tree.pager.allocate(root.asPage())
+	}
+}
+
 type InsertMode uint8
 
 const (
@@ -264,16 +316,22 @@ func treeDelete(tree *Btree, node BtreeNode, key []byte) *BtreeNode {
 
 		mergeDir, sibling := shouldMerge(tree, node, idx, *newChild)
 		if mergeDir == mergeNone {
-			updateChildren(tree, new, node, idx, idx+1, *newChild)
+			if newChild.getNkeys() == 0 {
+				// the child held only the key and has no sibling to merge with, it is dropped.
+				updateChildren(tree, new, node, idx, idx+1)
+			} else {
+				updateChildren(tree, new, node, idx, idx+1, *newChild)
+			}
 			return &new
 		}
 		merged := BtreeNode{data: make([]byte, PageSize)}
-		mergeNode(merged, *sibling, *newChild)
 		if mergeDir == mergeLeft {
+			mergeNode(merged, *sibling, *newChild)
 			tree.pager.free(node.getPointer(idx - 1))
 			// replace the left sibling and the child pointer with the merged node
 			updateChildren(tree, new, node, idx-1, idx+1, merged)
 		} else {
+			mergeNode(merged, *newChild, *sibling)
 			tree.pager.free(node.getPointer(idx + 1))
 			updateChildren(tree, new, node, idx, idx+2, merged)
 		}
@@ -284,6 +342,110 @@ func treeDelete(tree *Btree, node BtreeNode, key []byte) *BtreeNode {
 	}
 }
 
+// treeDeleteRange deletes the keys within [start, end) from the subtree rooted at the node, whose keys are less
+// than hi, nil if it is unbounded. The dummy key is never deleted.
+// It returns the new node, which may not fit in a page, and the number of keys deleted. If no key was deleted
+// it returns nil. As for treeDelete it is the caller's responsibility to free the old node.
+// The children which are left empty are dropped, the ones left small are not merged.
+func treeDeleteRange(tree *Btree, node BtreeNode, start, end, hi []byte, freeVal func(val []byte)) (*BtreeNode, int) {
+	nkeys := node.getNkeys()
+	if node.getNodeType() == BTREE_LEAF_NODE {
+		from, to := uint16(0), nkeys
+		for from < nkeys && (len(node.getKey(from)) == 0 || bytes.Compare(node.getKey(from), start) < 0) {
+			from++
+		}
+		for i := from; i < nkeys; i++ {
+			if end != nil && bytes.Compare(node.getKey(i), end) >= 0 {
+				to = i
+				break
+			}
+		}
+		if from >= to {
+			return nil, 0
+		}
+		for i := from; i < to; i++ {
+			freeVal(node.getValue(i))
+		}
+		new := newBtreeNode()
+		new.setHeader(BTREE_LEAF_NODE, nkeys-(to-from))
+		nodeCopyN(new, node, 0, 0, from)
+		nodeCopyN(new, node, from, to, nkeys-to)
+		return &new, int(to - from)
+	} else if node.getNodeType() != BTREE_INTERNAL_NODE {
+		panic(fmt.Sprintf("invalid node type: %v", node.getNodeType()))
+	}
+
+	var (
+		ptrs    []uint64
+		keys    [][]byte
+		deleted int
+	)
+	for i := uint16(0); i < nkeys; i++ {
+		lo, next := node.getKey(i), hi
+		if i+1 < nkeys {
+			next = node.getKey(i + 1)
+		}
+		ptr := node.getPointer(i)
+		switch {
+		case (next != nil && bytes.Compare(next, start) <= 0) || (end != nil && bytes.Compare(lo, end) >= 0):
+			// the child is outside the range.
+		case len(lo) != 0 && bytes.Compare(lo, start) >= 0 && (end == nil || (next != nil && bytes.Compare(next, end) <= 0)):
+			// the child is within the range, its pages are freed without being rewritten.
+			deleted += freeTree(tree, ptr, freeVal)
+			continue
+		default:
+			newChild, n := treeDeleteRange(tree, tree.pager.load(ptr).asBtreeNode(), start, end, next, freeVal)
+			if newChild == nil {
+				break
+			}
+			deleted += n
+			tree.pager.free(ptr)
+			if newChild.getNkeys() == 0 {
+				continue
+			}
+			nsplit, splitted := nodeSplit(*newChild)
+			for _, child := range splitted[:nsplit] {
+				ptrs = append(ptrs, tree.pager.allocate(child.asPage()))
+				keys = append(keys, child.getKey(0))
+			}
+			continue
+		}
+		ptrs = append(ptrs, ptr)
+		keys = append(keys, lo)
+	}
+	if deleted == 0 {
+		return nil, 0
+	}
+
+	size := BTREE_NODE_HEADER_SIZE
+	for _, key := range keys {
+		size += BTREE_POINTER_SIZE + BTREE_OFFSET_SIZE + BTREE_KEY_LEN_SIZE + BTREE_VALUE_LEN_SIZE + len(key)
+	}
+	new := BtreeNode{data: make([]byte, max(size, PageSize))}
+	new.setHeader(BTREE_INTERNAL_NODE, uint16(len(ptrs)))
+	for i := range ptrs {
+		nodeWriteAt(new, uint16(i), ptrs[i], keys[i], nil)
+	}
+	return &new, deleted
+}
+
+// freeTree frees the pages of the subtree rooted at the pointer, passing the values of its leaves to freeVal.
+// It returns the number of keys of the subtree.
+func freeTree(tree *Btree, ptr uint64, freeVal func(val []byte)) int {
+	node := tree.pager.load(ptr).asBtreeNode()
+	n := 0
+	for i := uint16(0); i < node.getNkeys(); i++ {
+		if node.getNodeType() == BTREE_LEAF_NODE {
+			freeVal(node.getValue(i))
+			n++
+		} else {
+			n += freeTree(tree, node.getPointer(i), freeVal)
+		}
+	}
+	tree.pager.free(ptr)
+	return n
+}
+
 // treeInsert inserts a key-value pair into the subtree rooted at the node.
 // It returns the new node after the insertion, the node is not guaranteed to fit in a page.
 // It is the caller's responsibility to free the old node and split the node if it is too large.
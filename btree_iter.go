@@ -167,6 +167,7 @@ func (iter *BtreeIter) prev() bool {
 }
 
 // SeekLE creates an iterator that starts at the first key less than or equal to the given key.
+// The iterator is invalid if the tree is empty.
 func (tree *Btree) SeekLE(key []byte) *BtreeIter {
 	iter := &BtreeIter{btree: tree}
 	for ptr := tree.root; ptr != 0; {
@@ -195,7 +196,7 @@ const (
 // If no key satisfies the comparison, an invalid iterator is returned.
 func (tree *Btree) Seek(key []byte, cmp Cmp) *BtreeIter {
 	iter := tree.SeekLE(key)
-	if cmp == CmpLE {
+	if cmp == CmpLE || !iter.isIterable() {
 		return iter
 	}
 	if cmp > 0 && isDummyKey(iter.cursor.node, iter.cursor.idx) {
@@ -77,4 +77,15 @@ func TestBtreeIter(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("empty", func(t *testing.T) {
+		empty := newBtree(0, newMemoryPager())
+		for _, cmp := range []Cmp{CmpGE, CmpGT, CmpLT, CmpLE} {
+			iter := empty.Seek([]byte("key"), cmp)
+			_, _, ok := iter.Cur()
+			require.False(t, ok)
+			require.False(t, iter.next())
+			require.False(t, iter.prev())
+		}
+	})
 }
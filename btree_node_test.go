@@ -28,7 +28,7 @@ func Test_setHeader(t *testing.T) {
 }
 
 func Test_getPointer(t *testing.T) {
-	node := BtreeNode{make([]byte, 28, 28)}
+	node := BtreeNode{make([]byte, BTREE_NODE_HEADER_SIZE+3*BTREE_POINTER_SIZE)}
 	node.setHeader(BTREE_INTERNAL_NODE, 3)
 	binary.LittleEndian.PutUint64(node.data[BTREE_NODE_HEADER_SIZE:], 1)
 	binary.LittleEndian.PutUint64(
@@ -51,7 +51,7 @@ func Test_getPointer(t *testing.T) {
 }
 
 func Test_setPointer(t *testing.T) {
-	node := BtreeNode{make([]byte, 20, 20)}
+	node := BtreeNode{make([]byte, BTREE_NODE_HEADER_SIZE+2*BTREE_POINTER_SIZE)}
 	node.setHeader(BTREE_INTERNAL_NODE, 2)
 	t.Run("index out of bounds", func(t *testing.T) {
 		defer func() {
@@ -403,6 +403,106 @@ func TestBtree(t *testing.T) {
 
 		}
 	})
+
+	t.Run("Delete", func(t *testing.T) {
+		n := uint64(50)
+		pager := newMemoryPager()
+		tree := newBtree(0, pager)
+		for k := uint64(0); k < n; k++ {
+			tree.Insert(encodeUint64Key(k), makeData(fmt.Sprintf("%d", k), 256))
+		}
+
+		// deleting in order merges the emptied leaves with their right sibling
+		for k := uint64(0); k < n; k++ {
+			require.Truef(t, tree.Delete(encodeUint64Key(k)), "key %d should be deleted", k)
+			_, ok := tree.Get(encodeUint64Key(k))
+			require.Falsef(t, ok, "key %d should not be found", k)
+			for j := k + 1; j < n; j++ {
+				_, ok := tree.Get(encodeUint64Key(j))
+				require.Truef(t, ok, "key %d should be found after deleting %d", j, k)
+			}
+		}
+	})
+
+	keys := func(tree *Btree) []string {
+		var keys []string
+		if tree.root == 0 {
+			return keys
+		}
+		for iter := tree.Seek([]byte{0}, CmpGE); ; iter.next() {
+			k, _, ok := iter.Cur()
+			if !ok {
+				return keys
+			}
+			keys = append(keys, string(k))
+		}
+	}
+
+	t.Run("DeleteEmptyingLeaves", func(t *testing.T) {
+		// inserting in order leaves single key leaves behind, deleting their key empties them.
+		tree := newBtree(0, newMemoryPager())
+		var expected []string
+		for i := 0; i < 500; i++ {
+			tree.Insert(walKey(i), []byte(fmt.Sprint(i)))
+			expected = append(expected, string(walKey(i)))
+		}
+		for i := 1; i < 500; i += 3 {
+			require.True(t, tree.Delete(walKey(i)))
+			expected = slices.DeleteFunc(expected, func(k string) bool { return k == string(walKey(i)) })
+		}
+		require.Equal(t, expected, keys(tree))
+		for _, k := range expected {
+			require.True(t, tree.Delete([]byte(k)))
+		}
+		require.Zero(t, tree.root)
+	})
+
+	t.Run("DeleteRange", func(t *testing.T) {
+		testCases := []struct {
+			start, end int
+			unbounded  bool
+		}{
+			{start: 10, end: 20},
+			{start: 0, end: 500},
+			{start: 250, unbounded: true},
+			{start: 0, unbounded: true},
+			{start: 499, end: 500},
+			{start: 20, end: 10},
+			{start: 600, unbounded: true},
+		}
+		for i, tc := range testCases {
+			t.Run(fmt.Sprint("testcase_", i+1), func(t *testing.T) {
+				for _, valSize := range []int{8, 1000} {
+					tree := newBtree(0, newMemoryPager())
+					var expected []string
+					for i := 0; i < 500; i++ {
+						tree.Insert(walKey(i), makeData(fmt.Sprint(i), valSize))
+						if i < tc.start || (!tc.unbounded && i >= tc.end) || (!tc.unbounded && tc.end <= tc.start) {
+							expected = append(expected, string(walKey(i)))
+						}
+					}
+					end := walKey(tc.end)
+					if tc.unbounded {
+						end = nil
+					}
+					freed := 0
+					n := tree.DeleteRange(walKey(tc.start), end, func(val []byte) { freed++ })
+					require.Equal(t, 500-len(expected), n)
+					require.Equal(t, n, freed)
+					require.Equal(t, expected, keys(tree))
+					for _, k := range expected {
+						_, ok := tree.Get([]byte(k))
+						require.True(t, ok)
+					}
+					// the tree is still usable.
+					tree.Insert(walKey(15), []byte("again"))
+					val, ok := tree.Get(walKey(15))
+					require.True(t, ok)
+					require.Equal(t, []byte("again"), val)
+				}
+			})
+		}
+	})
 }
 
 //
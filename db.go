@@ -2,9 +2,9 @@ package deadsimpledb
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/json"
 	"fmt"
+	"iter"
+	"sync"
 )
 
 const tableInitPrefix = 3
@@ -12,7 +12,7 @@ const tableInitPrefix = 3
 var metaDataTable = tableDef{
 	Prefix: 1,
 	Name:   "@meta",
-	Types:  []Type{typeBlob, typeBlob},
+	Types:  []Type{TypeBlob, TypeBlob},
 	Cols:   []string{"key", "value"},
 	Pkeys:  1,
 }
@@ -20,19 +20,26 @@ var metaDataTable = tableDef{
 var tableDefsTable = tableDef{
 	Prefix: 2,
 	Name:   "@table",
-	Types:  []Type{typeBlob, typeBlob},
+	Types:  []Type{TypeBlob, TypeBlob},
 	Cols:   []string{"name", "def"},
 	Pkeys:  1,
 }
 
+// DB is safe for concurrent use, see KV.
 type DB struct {
-	path   string
-	kv     *KV
+	path string
+	kv   *KV
+	// mu guards tables.
+	mu     sync.RWMutex
 	tables map[string]*tableDef
 }
 
 func NewDB(path string) (*DB, error) {
-	kv, err := NewKV(path)
+	return NewDBWithOptions(path, OpenOptions{})
+}
+
+func NewDBWithOptions(path string, opts OpenOptions) (*DB, error) {
+	kv, err := NewKVWithOptions(path, opts)
 	if err != nil {
 		return nil, fmt.Errorf("init kv: %w", err)
 	}
@@ -41,6 +48,10 @@ func NewDB(path string) (*DB, error) {
 		kv:     kv,
 		tables: make(map[string]*tableDef),
 	}
+	if err := db.migrate(); err != nil {
+		kv.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -48,245 +59,374 @@ func (db *DB) Close() error {
 	return db.kv.Close()
 }
 
+// update runs fn in a transaction which is committed if fn succeeds and aborted otherwise.
+// It fails with ErrReadOnly right away if the DB is opened read-only.
+func (db *DB) update(fn func(tx *Tx) error) error {
+	if db.kv.readOnly {
+		return ErrReadOnly
+	}
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
+}
+
+// view runs fn in a read-only transaction, it runs in parallel with the writer transaction.
+func (db *DB) view(fn func(tx *Tx) error) error {
+	tx := db.beginRead()
+	defer tx.Abort()
+	return fn(tx)
+}
+
 func (db *DB) Insert(table string, rec AnonymousRecord) (bool, error) {
-	return db.insert(table, rec, Insert)
+	var ok bool
+	err := db.update(func(tx *Tx) (err error) {
+		ok, err = tx.Insert(table, rec)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) Upsert(table string, rec AnonymousRecord) (bool, error) {
-	return db.insert(table, rec, Upsert)
+	var ok bool
+	err := db.update(func(tx *Tx) (err error) {
+		ok, err = tx.Upsert(table, rec)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) Delete(table string, ar AnonymousRecord) (bool, error) {
-	tdef, err := db.getTableDef(table)
-	if err != nil {
-		return false, fmt.Errorf("getting table definition: %w", err)
-	}
-	if tdef == nil {
-		return false, fmt.Errorf("table not found")
-	}
-	tr := ar.IntoTableRecord(tdef)
-	return db.deleteRecord(*tr)
+	var ok bool
+	err := db.update(func(tx *Tx) (err error) {
+		ok, err = tx.Delete(table, ar)
+		return err
+	})
+	return ok, err
+}
+
+// DeleteWhere deletes the records of the table between from and to in a single commit, see Tx.DeleteWhere.
+func (db *DB) DeleteWhere(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) (int, error) {
+	var n int
+	err := db.update(func(tx *Tx) (err error) {
+		n, err = tx.DeleteWhere(table, from, fromCmp, t, toCmp)
+		return err
+	})
+	return n, err
 }
 
+// Get looks up the record with the primary key of ar, see Tx.Get.
 func (db *DB) Get(table string, ar AnonymousRecord) (bool, error) {
-	tdef, err := db.getTableDef(table)
+	var ok bool
+	err := db.view(func(tx *Tx) (err error) {
+		ok, err = tx.Get(table, ar)
+		return err
+	})
+	return ok, err
+}
+
+// Scan returns a scanner over the records of the table between from and to, see Tx.Scan.
+// The scanner reads a snapshot of the last commit, which is released by closing the scanner.
+func (db *DB) Scan(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) (*Scanner, error) {
+	tx := db.beginRead()
+	sc, err := tx.Scan(table, from, fromCmp, t, toCmp)
 	if err != nil {
-		return false, fmt.Errorf("getting table definition: %w", err)
-	}
-	if tdef == nil {
-		return false, fmt.Errorf("table not found")
+		tx.Abort()
+		return nil, err
 	}
-	tr := ar.IntoTableRecord(tdef)
-	return db.getRecord(*tr)
+	sc.tx = tx
+	return sc, nil
+}
+
+// ScanAll returns a scanner over every record of the table, see Tx.ScanAll and DB.Scan.
+func (db *DB) ScanAll(table string) (*Scanner, error) {
+	return db.ScanPrefix(table)
 }
 
-func (db *DB) Scan(table string, from tableRecord, fromCmp Cmp, t tableRecord, toCmp Cmp) (*Scanner, error) {
-	tdef, err := db.getTableDef(table)
+// ScanPrefix returns a scanner over the records of the table whose primary key starts with pk, see Tx.ScanPrefix
+// and DB.Scan.
+func (db *DB) ScanPrefix(table string, pk ...Value) (*Scanner, error) {
+	tx := db.beginRead()
+	sc, err := tx.ScanPrefix(table, pk...)
 	if err != nil {
-		return nil, fmt.Errorf("getting table definition: %w", err)
+		tx.Abort()
+		return nil, err
 	}
-	if tdef == nil {
-		return nil, fmt.Errorf("table not found: %s", table)
+	sc.tx = tx
+	return sc, nil
+}
+
+// Rows returns the records of the table between from and to, see Tx.Scan.
+// The iteration reads a snapshot taken when it starts, which is released when it ends,
+// including when the loop is broken out of. An error ends the iteration.
+func (db *DB) Rows(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) iter.Seq2[Row, error] {
+	return func(yield func(Row, error) bool) {
+		tx := db.beginRead()
+		defer tx.Abort()
+		sc, err := tx.Scan(table, from, fromCmp, t, toCmp)
+		if err != nil {
+			yield(Row{}, err)
+			return
+		}
+		for row, err := range sc.All() {
+			if !yield(row, err) {
+				return
+			}
+		}
 	}
+}
 
-	return db.scan(from, fromCmp, t, toCmp)
+// Put inserts or overwrites the record of the struct, see Tx.Put.
+func (db *DB) Put(v any) error {
+	return db.update(func(tx *Tx) error {
+		return tx.Put(v)
+	})
 }
 
-func (db *DB) CreateTable(tdef *tableDef) error {
-	if err := tdef.Validate(); err != nil {
-		return fmt.Errorf("invalid table def: %w", err)
-	}
+// Load reads the record with the primary key of the struct into it, see Tx.Load.
+func (db *DB) Load(v any) (bool, error) {
+	var ok bool
+	err := db.view(func(tx *Tx) (err error) {
+		ok, err = tx.Load(v)
+		return err
+	})
+	return ok, err
+}
 
-	// check if the table exist
-	tdefRecord := newTableRecord(&tableDefsTable).SetBlob("name", []byte(tdef.Name))
-	if ok, err := db.getRecord(*tdefRecord); err != nil {
-		return fmt.Errorf("retreiving table definition: %w", err)
-	} else if ok {
-		return fmt.Errorf("table already exists")
-	}
+// ScanInto reads every record of the table of the slice element type into the slice, see Tx.ScanInto.
+func (db *DB) ScanInto(dst any) error {
+	return db.view(func(tx *Tx) error {
+		return tx.ScanInto(dst)
+	})
+}
 
-	metaRecord := newTableRecord(&metaDataTable).SetBlob("key", []byte("next_prefix"))
-	ok, err := db.getRecord(*metaRecord)
-	if err != nil {
-		return fmt.Errorf("retreiving next_prefix: %w", err)
-	}
-	if !ok {
-		tdef.Prefix = tableInitPrefix
-		metaRecord.SetBlob("value", make([]byte, 4))
-	} else {
-		tdef.Prefix = binary.LittleEndian.Uint32(metaRecord.Get("value").Blob)
-	}
+// CreateTable creates a table, see Tx.CreateTable.
+func (db *DB) CreateTable(schema *Schema) error {
+	return db.update(func(tx *Tx) error {
+		return tx.CreateTable(schema)
+	})
+}
 
-	// increment the next_prefix
-	binary.LittleEndian.PutUint32(metaRecord.Get("value").Blob, tdef.Prefix+1)
-	if _, err := db.insertRecord(*metaRecord, Upsert); err != nil {
-		return fmt.Errorf("updating next_prefix: %w", err)
-	}
+func (db *DB) createTable(tdef *tableDef) error {
+	return db.update(func(tx *Tx) error {
+		return tx.createTable(tdef)
+	})
+}
 
-	buf := new(bytes.Buffer)
-	if err := tdef.Serialize(buf); err != nil {
-		return fmt.Errorf("serializing table definition: %w", err)
-	}
-	tdefRecord.SetBlob("def", buf.Bytes())
-	if _, err := db.insertRecord(*tdefRecord, Insert); err != nil {
-		return fmt.Errorf("inserting table definition: %w", err)
-	}
-	db.tables[tdef.Name] = tdef
-	return nil
+// DropTable deletes the table and its records, see Tx.DropTable.
+func (db *DB) DropTable(table string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.DropTable(table)
+	})
 }
 
-func (db *DB) insert(table string, ar AnonymousRecord, mode InsertMode) (bool, error) {
-	tdef, err := db.getTableDef(table)
-	if err != nil {
-		return false, fmt.Errorf("getting table definition: %w", err)
-	}
-	if tdef == nil {
-		return false, fmt.Errorf("table not found")
-	}
-	tr := ar.IntoTableRecord(tdef)
-	return db.insertRecord(*tr, mode)
+// TruncateTable deletes the records of the table, see Tx.TruncateTable.
+func (db *DB) TruncateTable(table string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.TruncateTable(table)
+	})
 }
 
-func (db *DB) getTableDef(table string) (*tableDef, error) {
-	tdef, ok := db.tables[table]
-	if ok {
-		return tdef, nil
-	}
-	rec := newTableRecord(&tableDefsTable).SetBlob("name", []byte(table))
-	ok, err := db.getRecord(*rec)
-	if err != nil {
-		return nil, err
-	}
-	if !ok {
-		return nil, nil
-	}
-	tdef = new(tableDef)
-	err = json.Unmarshal(rec.Get("def").Blob, tdef)
-	if err != nil {
-		return nil, fmt.Errorf("unmarshaling: %w", err)
-	}
-	db.tables[table] = tdef
-	return tdef, nil
+// RenameTable renames the table, see Tx.RenameTable.
+func (db *DB) RenameTable(table, newName string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.RenameTable(table, newName)
+	})
 }
 
-func (db *DB) getRecord(rec tableRecord) (bool, error) {
-	if err := rec.ValidatePK(); err != nil {
-		return false, err
-	}
+// AlterTable changes the columns of the table, see Tx.AlterTable.
+func (db *DB) AlterTable(table string, alterations ...Alteration) error {
+	return db.update(func(tx *Tx) error {
+		return tx.AlterTable(table, alterations...)
+	})
+}
 
-	key := new(bytes.Buffer)
-	if err := rec.serializePK(key); err != nil {
-		return false, fmt.Errorf("serializing primary key: %w", err)
-	}
-	val, ok := db.kv.Get(key.Bytes())
-	if !ok {
-		return false, nil
-	}
+// UpgradeTable rewrites the records of the table written with a previous schema version, see Tx.UpgradeTable.
+func (db *DB) UpgradeTable(table string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.UpgradeTable(table)
+	})
+}
 
-	valBuf := bytes.NewBuffer(val)
-	if err := rec.deserializeValues(valBuf); err != nil {
-		return false, fmt.Errorf("decoding values: %w", err)
-	}
+// CreateIndex adds an index on the columns to the table, see Tx.CreateIndex.
+func (db *DB) CreateIndex(table string, cols []string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.CreateIndex(table, cols)
+	})
+}
 
-	return true, nil
+// CreateUniqueIndex adds a unique index on the columns to the table, see Tx.CreateUniqueIndex.
+func (db *DB) CreateUniqueIndex(table string, cols []string) error {
+	return db.update(func(tx *Tx) error {
+		return tx.CreateUniqueIndex(table, cols)
+	})
+}
+
+func (db *DB) getTableDef(table string) (*tableDef, error) {
+	var tdef *tableDef
+	err := db.view(func(tx *Tx) (err error) {
+		tdef, err = tx.getTableDef(table)
+		return err
+	})
+	return tdef, err
+}
+
+func (db *DB) getRecord(rec tableRecord) (bool, error) {
+	var ok bool
+	err := db.view(func(tx *Tx) (err error) {
+		ok, err = tx.getRecord(rec)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) deleteRecord(rec tableRecord) (bool, error) {
-	if err := rec.ValidatePK(); err != nil {
-		return false, err
-	}
-	key := new(bytes.Buffer)
-	if err := rec.serializePK(key); err != nil {
-		return false, fmt.Errorf("serializing primary key: %w", err)
-	}
-	return db.kv.Del(key.Bytes())
+	var ok bool
+	err := db.update(func(tx *Tx) (err error) {
+		ok, err = tx.deleteRecord(rec)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) insertRecord(rec tableRecord, mode InsertMode) (bool, error) {
-	if err := rec.validate(); err != nil {
-		return false, err
-	}
-	key := new(bytes.Buffer)
-	if err := rec.serializePK(key); err != nil {
-		return false, fmt.Errorf("serializing primary key: %w", err)
-	}
-	val := new(bytes.Buffer)
-	if err := rec.serializeValues(val); err != nil {
-		return false, fmt.Errorf("serializing non-primary key: %w", err)
-	}
-	return db.kv.Update(key.Bytes(), val.Bytes(), mode)
+	var ok bool
+	err := db.update(func(tx *Tx) (err error) {
+		ok, err = tx.insertRecord(rec, mode)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) scan(from tableRecord, fromCmp Cmp, t tableRecord, toCmp Cmp) (*Scanner, error) {
-	if !(fromCmp > 0 && toCmp < 0) {
-		return nil, fmt.Errorf("invalid range")
-	}
-
-	if err := from.ValidatePK(); err != nil {
-		return nil, fmt.Errorf("from : %w", err)
-	}
-	if err := t.ValidatePK(); err != nil {
-		return nil, fmt.Errorf("to : %w", err)
-	}
-
-	fromKey := new(bytes.Buffer)
-	if err := from.serializePK(fromKey); err != nil {
-		return nil, fmt.Errorf("serializing from key: %w", err)
-	}
-	toKey := new(bytes.Buffer)
-	if err := t.serializePK(toKey); err != nil {
-		return nil, fmt.Errorf("serializing to key: %w", err)
-	}
-	iter := db.kv.tree.Seek(fromKey.Bytes(), fromCmp)
-
-	scanner := &Scanner{
-		tdef:  t.tdef,
-		toKey: toKey.Bytes(),
-		toCmp: toCmp,
-		iter:  iter,
+	tx := db.beginRead()
+	sc, err := tx.scan(from, fromCmp, t, toCmp)
+	if err != nil {
+		tx.Abort()
+		return nil, err
 	}
-	return scanner, nil
+	sc.tx = tx
+	return sc, nil
 }
 
+// Scanner iterates over a range of records. It is valid as long as the transaction
+// or snapshot it is created from is, except for the one created by DB.Scan which owns its snapshot.
 type Scanner struct {
+	kv *KV
+	// tx is the read-only transaction owned by the scanner, it is ended by Close.
+	tx   *Tx
 	tdef *tableDef
-	iter *BtreeIter
-	// encoded Key1eIter
+	// index is the index the scanner ranges over, -1 for the primary key.
+	index int
+	iter  *BtreeIter
+	// toKey is the encoded end bound, the lower one for a descending scanner. The keys of an index are compared on the indexed columns only,
+	// as they are followed by the primary key.
 	toKey []byte
 	toCmp Cmp
+	// desc is true if the scanner moves from the largest key down.
+	desc bool
+	// err is the error that stopped the scanner, it is returned by Cur.
+	err error
 }
 
 // Valid returns true if the scanner is within specified range
 func (sc *Scanner) Valid() bool {
-	if sc.iter == nil {
+	sc.kv.mu.RLock()
+	defer sc.kv.mu.RUnlock()
+	return sc.valid()
+}
+
+func (sc *Scanner) valid() bool {
+	if sc.iter == nil || sc.err != nil {
 		return false
 	}
 	if !sc.iter.isIterable() {
 		return false
 	}
 	key, _, _ := sc.iter.Cur()
+	if sc.index >= 0 {
+		// the encoding of the indexed columns is prefix-free, so the truncated key compares as its indexed columns.
+		key = key[:min(len(key), len(sc.toKey))]
+	}
 	return cmpOK(key, sc.toCmp, sc.toKey)
 }
 
-// Next moves the scanner to the next record
+// Next moves the scanner to the next record, which is the previous one in the key order for a descending scanner.
+// If it fails to load the next record the scanner becomes invalid and Cur returns the error.
 func (sc *Scanner) Next() {
-	assert(sc.Valid(), "scanner is invalid")
-	sc.iter.next()
+	sc.kv.mu.RLock()
+	defer sc.kv.mu.RUnlock()
+	assert(sc.valid(), "scanner is invalid")
+	defer recoverPanic(&sc.err)
+	if sc.desc {
+		sc.iter.prev()
+	} else {
+		sc.iter.next()
+	}
+}
+
+// All returns the records from the current one to the end of the range, moving the scanner along.
+// An error ends the iteration. It does not close the scanner.
+func (sc *Scanner) All() iter.Seq2[Row, error] {
+	return func(yield func(Row, error) bool) {
+		for ; sc.Valid(); sc.Next() {
+			row, _, err := sc.Cur()
+			if err != nil {
+				yield(Row{}, err)
+				return
+			}
+			if !yield(*row, nil) {
+				return
+			}
+		}
+		if _, _, err := sc.Cur(); err != nil {
+			yield(Row{}, err)
+		}
+	}
+}
+
+// Close releases the snapshot owned by the scanner, if any.
+func (sc *Scanner) Close() {
+	if sc.tx != nil {
+		sc.tx.Abort()
+	}
 }
 
 // Cur returns the current record
-func (sc *Scanner) Cur() (*tableRecord, bool, error) {
-	if !sc.Valid() {
+func (sc *Scanner) Cur() (_ *Row, _ bool, err error) {
+	sc.kv.mu.RLock()
+	defer sc.kv.mu.RUnlock()
+	if sc.err != nil {
+		return nil, false, sc.err
+	}
+	if !sc.valid() {
 		return nil, false, nil
 	}
-	key, val, _ := sc.iter.Cur()
+	defer recoverPanic(&err)
+	key, stored, _ := sc.iter.Cur()
 	rec := newTableRecord(sc.tdef)
 
-	if err := rec.deserializePK(bytes.NewReader(key)); err != nil {
+	if sc.index >= 0 {
+		if err := rec.deserializeIndexKey(bytes.NewReader(key), sc.index); err != nil {
+			return nil, false, fmt.Errorf("decoding index key: %w", err)
+		}
+		// the record is read from the tree the index is read from.
+		pk := new(bytes.Buffer)
+		if err := rec.serializePK(pk); err != nil {
+			return nil, false, fmt.Errorf("serializing primary key: %w", err)
+		}
+		var ok bool
+		if stored, ok = sc.iter.btree.Get(pk.Bytes()); !ok {
+			return nil, false, fmt.Errorf("%w: index key %q points to no record", ErrCorrupt, key)
+		}
+	} else if err := rec.deserializePK(bytes.NewReader(key)); err != nil {
 		return nil, false, fmt.Errorf("decoding primary key: %w", err)
 	}
+	val := decodeValue(sc.kv.pager, stored)
 	if err := rec.deserializeValues(bytes.NewReader(val)); err != nil {
 		return nil, false, fmt.Errorf("decoding values: %w", err)
 	}
-	return rec, true, nil
+	return &Row{rec: rec}, true, nil
 }
@@ -0,0 +1,33 @@
+package deadsimpledb
+
+// Snapshot is a read-only view of a DB as of the commit it was taken at, see KVSnapshot.
+// It must be closed once done with, which invalidates the scanners created from it.
+type Snapshot struct {
+	tx *Tx
+}
+
+// Snapshot takes a snapshot of the last commit.
+func (db *DB) Snapshot() *Snapshot {
+	return &Snapshot{tx: db.beginRead()}
+}
+
+func (s *Snapshot) Get(table string, ar AnonymousRecord) (bool, error) {
+	return s.tx.Get(table, ar)
+}
+
+func (s *Snapshot) Scan(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) (*Scanner, error) {
+	return s.tx.Scan(table, from, fromCmp, t, toCmp)
+}
+
+func (s *Snapshot) ScanAll(table string) (*Scanner, error) {
+	return s.tx.ScanAll(table)
+}
+
+func (s *Snapshot) ScanPrefix(table string, pk ...Value) (*Scanner, error) {
+	return s.tx.ScanPrefix(table, pk...)
+}
+
+// Close releases the snapshot. Closing a snapshot that is already closed is a no-op.
+func (s *Snapshot) Close() {
+	s.tx.Abort()
+}
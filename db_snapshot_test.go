@@ -0,0 +1,119 @@
+package deadsimpledb
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	setupDB := func(t *testing.T) *DB {
+		db, err := NewDB(path.Join(t.TempDir(), "snapshot.db"))
+		require.NoError(t, err)
+		require.NoError(t, db.createTable(&tableDef{
+			Name:  "users",
+			Types: []Type{TypeInt64, TypeBlob},
+			Cols:  []string{"id", "name"},
+			Pkeys: 1,
+		}))
+		for i := 0; i < 100; i++ {
+			_, err := db.Insert("users", AnonymousRecord{"id": Int64(int64(i)), "name": Blob(makeData("bob", 200))})
+			require.NoError(t, err)
+		}
+		return db
+	}
+	deleteAll := func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i++ {
+			_, err := db.Delete("users", AnonymousRecord{"id": Int64(int64(i))})
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("get", func(t *testing.T) {
+		db := setupDB(t)
+		defer db.Close()
+
+		snap := db.Snapshot()
+		deleteAll(t, db)
+		for i := 0; i < 100; i++ {
+			ok, err := snap.Get("users", AnonymousRecord{"id": Int64(int64(i))})
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		snap.Close()
+
+		_, err := snap.Get("users", AnonymousRecord{"id": Int64(0)})
+		require.ErrorIs(t, err, ErrSnapshotClosed)
+	})
+
+	t.Run("scan_during_writes", func(t *testing.T) {
+		db := setupDB(t)
+		defer db.Close()
+
+		sc, err := db.Scan("users", AnonymousRecord{"id": Int64(0)}, CmpGE, AnonymousRecord{"id": Int64(99)}, CmpLE)
+		require.NoError(t, err)
+		defer sc.Close()
+
+		n := int64(0)
+		for ; sc.Valid(); sc.Next() {
+			rec, ok, err := sc.Cur()
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, n, rec.Get("id").I64)
+			n++
+			if n == 10 {
+				// rewrite the whole table while the scan is in progress
+				deleteAll(t, db)
+				for i := 100; i < 200; i++ {
+					_, err := db.Insert("users", AnonymousRecord{"id": Int64(int64(i)), "name": Blob(makeData("alice", 200))})
+					require.NoError(t, err)
+				}
+			}
+		}
+		require.Equal(t, int64(100), n)
+	})
+
+	t.Run("schema_changes", func(t *testing.T) {
+		db := setupDB(t)
+		defer db.Close()
+		columns := func(sc *Scanner, err error) []string {
+			require.NoError(t, err)
+			defer sc.Close()
+			require.True(t, sc.Valid())
+			row, _, err := sc.Cur()
+			require.NoError(t, err)
+			return row.Columns()
+		}
+
+		// the snapshot keeps reading the definitions of its commit and does not leak them into the DB.
+		snap := db.Snapshot()
+		require.NoError(t, db.AlterTable("users", AddColumn("age", TypeInt64)))
+		require.Equal(t, []string{"id", "name"}, columns(snap.ScanAll("users")))
+		require.Equal(t, []string{"id", "name", "age"}, columns(db.ScanAll("users")))
+		snap.Close()
+
+		snap = db.Snapshot()
+		require.NoError(t, db.RenameTable("users", "people"))
+		ok, err := snap.Get("users", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, err = db.Get("users", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+		ok, err = db.Get("people", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		snap.Close()
+
+		snap = db.Snapshot()
+		defer snap.Close()
+		require.NoError(t, db.DropTable("people"))
+		ok, err = snap.Get("people", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, err = db.Get("people", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+		_, err = db.Insert("people", AnonymousRecord{"id": Int64(1000)})
+		require.Error(t, err)
+	})
+}
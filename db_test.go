@@ -1,7 +1,10 @@
 package deadsimpledb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"math"
 	"path"
 	"slices"
 	"testing"
@@ -21,14 +24,14 @@ func TestDB(t *testing.T) {
 	t.Run("Table", func(t *testing.T) {
 		tdef := &tableDef{
 			Name:  "test_table",
-			Types: []Type{typeInt64, typeBlob, typeInt64},
+			Types: []Type{TypeInt64, TypeBlob, TypeInt64},
 			Cols:  []string{"key", "field1", "flied2"},
 			Pkeys: 1,
 		}
 		db := setupDB()
 		defer db.Close()
 		// Store table def in db
-		err := db.CreateTable(tdef)
+		err := db.createTable(tdef)
 		require.NoError(t, err, "failed to create table")
 
 		// clear table def cache
@@ -47,7 +50,7 @@ func TestDB(t *testing.T) {
 
 	testTdef := &tableDef{
 		Name:  "test_table",
-		Types: []Type{typeInt64, typeBlob, typeInt64},
+		Types: []Type{TypeInt64, TypeBlob, TypeInt64},
 		Cols:  []string{"key", "field1", "flied2"},
 		Pkeys: 1,
 	}
@@ -59,8 +62,8 @@ func TestDB(t *testing.T) {
 	// 		SetInt64("flied2", 2),
 	// 	newTableRecord(testTdef).
 	// 		SetInt64("key", 2).
-	// 		SetVal("field1", newNullValue(typeBlob)).
-	// 		SetVal("flied2", newNullValue(typeInt64)),
+	// 		SetVal("field1", Null(TypeBlob)).
+	// 		SetVal("flied2", Null(TypeInt64)),
 	// }
 
 	tr := newTableRecord(testTdef).
@@ -154,6 +157,33 @@ func TestDB(t *testing.T) {
 		})
 	})
 
+	t.Run("large_blob", func(t *testing.T) {
+		db := setupDB()
+		defer db.Close()
+
+		large := newTableRecord(testTdef).
+			SetInt64("key", 1).
+			SetBlob("field1", makeData("hello", 300*1024)).
+			SetInt64("flied2", 2)
+		ok, err := db.insertRecord(*large, Insert)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		_tr := newTableRecord(testTdef).SetInt64("key", 1)
+		ok, err = db.getRecord(*_tr)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, large, _tr)
+
+		sc, err := db.scan(*_tr, CmpGE, *_tr, CmpLE)
+		require.NoError(t, err)
+		defer sc.Close()
+		rec, ok, err := sc.Cur()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, large, rec.rec)
+	})
+
 	t.Run("deleteRecord", func(t *testing.T) {
 		db := setupDB()
 		defer db.Close()
@@ -180,8 +210,8 @@ func TestDB(t *testing.T) {
 		setUpRecordWithKey := func(key int64) tableRecord {
 			return *newTableRecord(testTdef).
 				SetInt64("key", key).
-				SetVal("field1", newNullValue(typeBlob)).
-				SetVal("field2", newNullValue(typeInt64))
+				SetVal("field1", Null(TypeBlob)).
+				SetVal("field2", Null(TypeInt64))
 		}
 
 		recordKeys := []int64{1, 3, 6, 12}
@@ -250,7 +280,7 @@ func TestDB(t *testing.T) {
 						r, ok, err := scanner.Cur()
 						require.NoError(t, err)
 						require.Truef(t, ok, "expected %v but got invalid", records[i])
-						require.Equal(t, records[i], *r)
+						require.Equal(t, records[i], *r.rec)
 						scanner.Next()
 					}
 				}
@@ -258,4 +288,873 @@ func TestDB(t *testing.T) {
 		}
 
 	})
+
+	t.Run("scan_numeric_order", func(t *testing.T) {
+		db := setupDB()
+		defer db.Close()
+		keys := []int64{256, -1, 1, 70000, -256, 0, 255}
+		for _, k := range keys {
+			ok, err := db.insertRecord(*newTableRecord(testTdef).SetInt64("key", k), Insert)
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+
+		scanner, err := db.scan(*newTableRecord(testTdef).SetInt64("key", -1), CmpGE,
+			*newTableRecord(testTdef).SetInt64("key", 300), CmpLT)
+		require.NoError(t, err)
+		var got []int64
+		for scanner.Valid() {
+			r, _, err := scanner.Cur()
+			require.NoError(t, err)
+			got = append(got, r.Get("key").I64)
+			scanner.Next()
+		}
+		require.Equal(t, []int64{-1, 0, 1, 255, 256}, got)
+	})
+}
+
+func TestDBNullValues(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "null.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tdef := &tableDef{
+		Name:  "values",
+		Types: []Type{TypeInt64, TypeBlob, TypeInt64},
+		Cols:  []string{"id", "blob", "int"},
+		Pkeys: 1,
+	}
+	require.NoError(t, db.createTable(tdef))
+
+	records := []*tableRecord{
+		newTableRecord(tdef).SetInt64("id", math.MinInt64).SetBlob("blob", []byte{}).SetInt64("int", math.MinInt64),
+		newTableRecord(tdef).SetInt64("id", 0),
+		newTableRecord(tdef).SetInt64("id", 1).SetBlob("blob", []byte{0}).SetInt64("int", 0),
+	}
+	for _, r := range records {
+		ok, err := db.insertRecord(*r, Insert)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	for _, r := range records {
+		got := newTableRecord(tdef).SetInt64("id", r.Get("id").I64)
+		ok, err := db.getRecord(*got)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, r.Vals, got.Vals)
+	}
+
+	sc, err := db.Scan("values", AnonymousRecord{"id": Int64(math.MinInt64)}, CmpGE,
+		AnonymousRecord{"id": Int64(math.MaxInt64)}, CmpLE)
+	require.NoError(t, err)
+	defer sc.Close()
+	for _, r := range records {
+		got, ok, err := sc.Cur()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, r.Vals, got.rec.Vals)
+		sc.Next()
+	}
+	require.False(t, sc.Valid())
+}
+
+func TestDBRicherTypes(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "types.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tdef := &tableDef{
+		Name:  "events",
+		Types: []Type{TypeFloat64, TypeString, TypeBool, TypeTimestamp, TypeUUID},
+		Cols:  []string{"score", "name", "done", "at", "id"},
+		Pkeys: 2,
+	}
+	require.NoError(t, db.createTable(tdef))
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6, time.FixedZone("UTC+7", 7*60*60))
+	scores := []float64{2.5, -10, 0, -0.5, 1e9}
+	for i, score := range scores {
+		r := newTableRecord(tdef).SetFloat64("score", score).SetString("name", "é").
+			SetBool("done", i%2 == 0).SetTimestamp("at", at).SetUUID("id", [16]byte{15: byte(i)})
+		ok, err := db.insertRecord(*r, Insert)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	r := newTableRecord(tdef).SetFloat64("score", 2.5).SetString("name", "é")
+	ok, err := db.getRecord(*r)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, r.Get("done").Bool)
+	require.True(t, at.Equal(r.Get("at").Time))
+	require.Equal(t, time.UTC, r.Get("at").Time.Location())
+	require.Equal(t, [16]byte{}, r.Get("id").UUID)
+
+	sc, err := db.Scan("events", AnonymousRecord{"score": Float64(-10), "name": String("")}, CmpGT,
+		AnonymousRecord{"score": Float64(1e9), "name": String("")}, CmpLT)
+	require.NoError(t, err)
+	defer sc.Close()
+	var got []float64
+	for sc.Valid() {
+		r, _, err := sc.Cur()
+		require.NoError(t, err)
+		got = append(got, r.Get("score").F64)
+		sc.Next()
+	}
+	require.Equal(t, []float64{-10, -0.5, 0, 2.5}, got)
+
+	_, err = db.insertRecord(*newTableRecord(tdef).SetFloat64("score", 1).SetString("name", "\xff"), Insert)
+	require.Error(t, err)
+	mistyped := newTableRecord(tdef).SetFloat64("score", 1).SetString("name", "x")
+	mistyped.Vals[slices.Index(tdef.Cols, "done")] = Int64(1)
+	_, err = db.insertRecord(*mistyped, Insert)
+	require.ErrorContains(t, err, "expected bool for done got int")
+
+	// the timestamps whose nanoseconds since the epoch do not fit in an int64 are rejected.
+	for _, at := range []time.Time{time.Date(1677, 9, 21, 0, 12, 43, 0, time.UTC), time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		_, err = db.insertRecord(*newTableRecord(tdef).SetFloat64("score", 1).SetString("name", "x").SetTimestamp("at", at), Insert)
+		require.ErrorContains(t, err, "timestamp out of range")
+	}
+	for i, at := range []time.Time{time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)} {
+		r := newTableRecord(tdef).SetFloat64("score", float64(i)).SetString("name", "x").SetTimestamp("at", at)
+		_, err = db.insertRecord(*r, Insert)
+		require.NoError(t, err)
+		r = newTableRecord(tdef).SetFloat64("score", float64(i)).SetString("name", "x")
+		ok, err := db.getRecord(*r)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, at.Equal(r.Get("at").Time))
+	}
+}
+
+func TestDBSchema(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "schema.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	schema := NewSchema("users").
+		Column("email", TypeString).
+		Column("id", TypeInt64).
+		ColumnDefault("admin", Bool(false)).
+		Column("age", TypeInt64).
+		PrimaryKey("id").
+		UniqueIndex("email")
+	require.NoError(t, db.CreateTable(schema))
+	require.Error(t, db.CreateTable(NewSchema("posts").Column("id", TypeInt64)))
+
+	for i, email := range []string{"c@example.com", "a@example.com", "b@example.com"} {
+		_, err := db.Insert("users", AnonymousRecord{"id": Int64(int64(i)), "email": String(email), "age": Int64(int64(20 + i))})
+		require.NoError(t, err)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		ar := AnonymousRecord{"id": Int64(1)}
+		ok, err := db.Get("users", ar)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, AnonymousRecord{"id": Int64(1), "email": String("a@example.com"), "admin": Bool(false), "age": Int64(21)}, ar)
+	})
+
+	t.Run("scan_rows", func(t *testing.T) {
+		sc, err := db.Scan("users", AnonymousRecord{"email": String("")}, CmpGE, AnonymousRecord{"email": String("z")}, CmpLT)
+		require.NoError(t, err)
+		defer sc.Close()
+		var ids []int64
+		for ; sc.Valid(); sc.Next() {
+			row, ok, err := sc.Cur()
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, []string{"id", "email", "admin", "age"}, row.Columns())
+			require.Equal(t, row.Int64("id")+20, row.Int64("age"))
+			require.False(t, row.Bool("admin"))
+			require.False(t, row.IsNull("admin"))
+			require.Equal(t, row.Get("email").Str, row.String("email"))
+			// the getters of another type or of an unknown column return the zero value.
+			require.Zero(t, row.Int64("email"))
+			require.True(t, row.IsNull("missing"))
+			require.Equal(t, Value{}, row.Get("missing"))
+			ids = append(ids, row.Int64("id"))
+		}
+		require.Equal(t, []int64{1, 2, 0}, ids)
+	})
+}
+
+func TestDBRows(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "rows.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.CreateTable(NewSchema("users").Column("id", TypeInt64).Column("name", TypeString).PrimaryKey("id")))
+	for i := int64(0); i < 10; i++ {
+		_, err := db.Insert("users", AnonymousRecord{"id": Int64(i), "name": String(fmt.Sprint("user", i))})
+		require.NoError(t, err)
+	}
+
+	var names []string
+	for row, err := range db.Rows("users", AnonymousRecord{"id": Int64(3)}, CmpGT, AnonymousRecord{"id": Int64(6)}, CmpLE) {
+		require.NoError(t, err)
+		names = append(names, row.String("name"))
+	}
+	require.Equal(t, []string{"user4", "user5", "user6"}, names)
+
+	names = nil
+	for row, err := range db.Rows("users", AnonymousRecord{"id": Int64(6)}, CmpLE, AnonymousRecord{"id": Int64(3)}, CmpGT) {
+		require.NoError(t, err)
+		names = append(names, row.String("name"))
+	}
+	require.Equal(t, []string{"user6", "user5", "user4"}, names)
+
+	// breaking out of the loop releases the snapshot, so the writer can reuse the pages.
+	for row, err := range db.Rows("users", AnonymousRecord{"id": Int64(0)}, CmpGE, AnonymousRecord{"id": Int64(9)}, CmpLE) {
+		require.NoError(t, err)
+		_, err = db.Delete("users", AnonymousRecord{"id": row.Get("id")})
+		require.NoError(t, err)
+		break
+	}
+	require.Empty(t, db.kv.pager.freeList.pins)
+
+	for _, err := range db.Rows("missing", AnonymousRecord{}, CmpGE, AnonymousRecord{}, CmpLE) {
+		require.Error(t, err)
+	}
+}
+
+func TestDBScanPrefix(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "scan_prefix.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.CreateTable(NewSchema("scores").
+		Column("game", TypeString).Column("player", TypeInt64).Column("points", TypeInt64).PrimaryKey("game", "player")))
+	require.NoError(t, db.CreateTable(NewSchema("empty").Column("id", TypeInt64).PrimaryKey("id")))
+	for i, game := range []string{"chess", "go", "go2"} {
+		for player := int64(0); player < 3; player++ {
+			_, err := db.Insert("scores", AnonymousRecord{"game": String(game), "player": Int64(player), "points": Int64(int64(i*10) + player)})
+			require.NoError(t, err)
+		}
+	}
+	points := func(sc *Scanner, err error) []int64 {
+		require.NoError(t, err)
+		defer sc.Close()
+		var points []int64
+		for row, err := range sc.All() {
+			require.NoError(t, err)
+			points = append(points, row.Int64("points"))
+		}
+		return points
+	}
+
+	require.Equal(t, []int64{0, 1, 2, 10, 11, 12, 20, 21, 22}, points(db.ScanAll("scores")))
+	require.Empty(t, points(db.ScanAll("empty")))
+	// the partial key matches whole columns, "go" is not a prefix of "go2".
+	require.Equal(t, []int64{10, 11, 12}, points(db.ScanPrefix("scores", String("go"))))
+	require.Equal(t, []int64{21}, points(db.ScanPrefix("scores", String("go2"), Int64(1))))
+	require.Empty(t, points(db.ScanPrefix("scores", String("g"))))
+	require.Equal(t, []int64{0, 1, 2, 10, 11, 12, 20, 21, 22}, points(db.ScanPrefix("scores")))
+
+	snap := db.Snapshot()
+	defer snap.Close()
+	require.Equal(t, []int64{0, 1, 2}, points(snap.ScanPrefix("scores", String("chess"))))
+	require.Len(t, points(snap.ScanAll("scores")), 9)
+
+	_, err = db.ScanAll("missing")
+	require.Error(t, err)
+	_, err = db.ScanPrefix("scores", Int64(1))
+	require.Error(t, err)
+	_, err = db.ScanPrefix("scores", Null(TypeString))
+	require.Error(t, err)
+	_, err = db.ScanPrefix("scores", String("go"), Int64(1), Int64(1))
+	require.Error(t, err)
+}
+
+func TestDBDeleteWhere(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "delete_where.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.CreateTable(NewSchema("events").Column("id", TypeInt64).Column("payload", TypeBlob).PrimaryKey("id")))
+	require.NoError(t, db.CreateTable(NewSchema("users").
+		Column("id", TypeInt64).Column("age", TypeInt64).PrimaryKey("id").Index("age")))
+	for i := int64(0); i < 300; i++ {
+		_, err := db.Insert("events", AnonymousRecord{"id": Int64(i), "payload": Blob(bytes.Repeat([]byte{byte(i)}, int(i%3)*PageSize))})
+		require.NoError(t, err)
+		_, err = db.Insert("users", AnonymousRecord{"id": Int64(i), "age": Int64(i % 10)})
+		require.NoError(t, err)
+	}
+	id := func(i int64) AnonymousRecord {
+		return AnonymousRecord{"id": Int64(i)}
+	}
+	age := func(i int64) AnonymousRecord {
+		return AnonymousRecord{"age": Int64(i)}
+	}
+	count := func(table string) int {
+		sc, err := db.ScanAll(table)
+		require.NoError(t, err)
+		defer sc.Close()
+		n := 0
+		for _, err := range sc.All() {
+			require.NoError(t, err)
+			n++
+		}
+		return n
+	}
+
+	t.Run("primary_key", func(t *testing.T) {
+		n, err := db.DeleteWhere("events", id(10), CmpGE, id(100), CmpLT)
+		require.NoError(t, err)
+		require.Equal(t, 90, n)
+		n, err = db.DeleteWhere("events", id(100), CmpGT, id(200), CmpLE)
+		require.NoError(t, err)
+		require.Equal(t, 100, n)
+		// a descending range deletes the same records as the ascending one.
+		n, err = db.DeleteWhere("events", id(250), CmpLT, id(9), CmpGT)
+		require.NoError(t, err)
+		require.Equal(t, 50, n)
+		require.Equal(t, 60, count("events"))
+
+		for _, i := range []int64{0, 9, 250, 299} {
+			ok, err := db.Get("events", id(i))
+			require.NoError(t, err)
+			require.True(t, ok, i)
+		}
+		for _, i := range []int64{10, 100, 200, 249} {
+			ok, err := db.Get("events", id(i))
+			require.NoError(t, err)
+			require.False(t, ok, i)
+		}
+	})
+
+	t.Run("indexed", func(t *testing.T) {
+		// the records are deleted over many batches.
+		defer func(batch int) { deleteWhereBatch = batch }(deleteWhereBatch)
+		deleteWhereBatch = 7
+
+		n, err := db.DeleteWhere("users", id(0), CmpGE, id(90), CmpLT)
+		require.NoError(t, err)
+		require.Equal(t, 90, n)
+		n, err = db.DeleteWhere("users", id(100), CmpLT, id(90), CmpGE)
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+		// the index keys are deleted along with the records.
+		n, err = db.DeleteWhere("users", age(3), CmpGE, age(5), CmpLT)
+		require.NoError(t, err)
+		require.Equal(t, 40, n)
+		require.Equal(t, 160, count("users"))
+
+		sc, err := db.Scan("users", age(0), CmpGE, age(9), CmpLE)
+		require.NoError(t, err)
+		defer sc.Close()
+		n = 0
+		for row, err := range sc.All() {
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, row.Int64("id"), int64(100))
+			require.NotContains(t, []int64{3, 4}, row.Int64("age"))
+			n++
+		}
+		require.Equal(t, 160, n)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := db.DeleteWhere("missing", id(0), CmpGE, id(1), CmpLT)
+		require.Error(t, err)
+		_, err = db.DeleteWhere("events", id(0), CmpGE, id(1), CmpGE)
+		require.Error(t, err)
+		_, err = db.DeleteWhere("events", AnonymousRecord{}, CmpGE, id(1), CmpLT)
+		require.Error(t, err)
+		require.Equal(t, 60, count("events"))
+	})
+}
+
+func TestDBReadOnly(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "readonly.db")
+	db, err := NewDB(dbPath)
+	require.NoError(t, err)
+	tdef := &tableDef{
+		Name:  "users",
+		Types: []Type{TypeInt64, TypeBlob},
+		Cols:  []string{"id", "name"},
+		Pkeys: 1,
+	}
+	require.NoError(t, db.createTable(tdef))
+	_, err = db.Insert("users", AnonymousRecord{"id": Int64(1), "name": Blob([]byte("bob"))})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = NewDBWithOptions(dbPath, OpenOptions{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	ok, err := db.Get("users", AnonymousRecord{"id": Int64(1)})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = db.Insert("users", AnonymousRecord{"id": Int64(2), "name": Blob([]byte("alice"))})
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = db.Delete("users", AnonymousRecord{"id": Int64(1)})
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, db.createTable(&tableDef{
+		Name:  "posts",
+		Types: []Type{TypeInt64},
+		Cols:  []string{"id"},
+		Pkeys: 1,
+	}), ErrReadOnly)
+	tx := db.Begin()
+	_, err = tx.Insert("users", AnonymousRecord{"id": Int64(2), "name": Blob([]byte("alice"))})
+	require.ErrorIs(t, err, ErrReadOnly)
+	tx.Abort()
+}
+
+func TestDBInvalidInput(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "input.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.createTable(&tableDef{
+		Name:  "docs",
+		Types: []Type{TypeBlob, TypeBlob},
+		Cols:  []string{"name", "body"},
+		Pkeys: 1,
+	}))
+
+	t.Run("key_too_large", func(t *testing.T) {
+		_, err := db.Insert("docs", AnonymousRecord{"name": Blob(makeData("name", BtreeMaxKeySize)), "body": Blob([]byte("body"))})
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+		_, err = db.Get("docs", AnonymousRecord{"name": Blob(makeData("name", BtreeMaxKeySize))})
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+	})
+
+	t.Run("corrupted_record", func(t *testing.T) {
+		tdef, err := db.getTableDef("docs")
+		require.NoError(t, err)
+		key := new(bytes.Buffer)
+		require.NoError(t, newTableRecord(tdef).SetBlob("name", []byte("bad")).serializePK(key))
+		// a blob longer than the data
+		require.NoError(t, db.kv.Set(key.Bytes(), []byte{0, 0, 0, 0, 0x00, 0x05, 0x00, 0x00, 0x00, 'a'}))
+
+		_, err = db.Get("docs", AnonymousRecord{"name": Blob([]byte("bad"))})
+		require.ErrorIs(t, err, ErrCorrupt)
+	})
+}
+
+func TestDBIndex(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "index.db"))
+	require.NoError(t, err)
+	// db is reopened by the last subtest.
+	defer func() { db.Close() }()
+	tdef := &tableDef{
+		Name:    "users",
+		Types:   []Type{TypeInt64, TypeBlob, TypeInt64},
+		Cols:    []string{"id", "name", "age"},
+		Pkeys:   1,
+		Indexes: [][]string{{"age", "name"}},
+	}
+	require.NoError(t, db.createTable(tdef))
+
+	insert := func(id int64, name string, age int64) {
+		ok, err := db.Upsert("users", AnonymousRecord{"id": Int64(id), "name": Blob([]byte(name)), "age": Int64(age)})
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	scanIDs := func(from AnonymousRecord, fromCmp Cmp, to AnonymousRecord, toCmp Cmp) []int64 {
+		sc, err := db.Scan("users", from, fromCmp, to, toCmp)
+		require.NoError(t, err)
+		defer sc.Close()
+		var ids []int64
+		for sc.Valid() {
+			r, ok, err := sc.Cur()
+			require.NoError(t, err)
+			require.True(t, ok)
+			ids = append(ids, r.Get("id").I64)
+			sc.Next()
+		}
+		return ids
+	}
+	bound := func(age int64, name string) AnonymousRecord {
+		return AnonymousRecord{"age": Int64(age), "name": Blob([]byte(name))}
+	}
+
+	insert(1, "bob", 30)
+	insert(2, "alice", 25)
+	insert(3, "carol", 30)
+	insert(4, "dave", 40)
+	insert(5, "bob", 30)
+
+	t.Run("range", func(t *testing.T) {
+		require.Equal(t, []int64{2, 1, 5, 3, 4}, scanIDs(bound(0, ""), CmpGE, bound(100, ""), CmpLE))
+		require.Equal(t, []int64{1, 5, 3}, scanIDs(bound(30, "bob"), CmpGE, bound(30, "carol"), CmpLE))
+		require.Equal(t, []int64{3}, scanIDs(bound(30, "bob"), CmpGT, bound(30, "dave"), CmpLT))
+		require.Equal(t, []int64{1, 5}, scanIDs(bound(25, "alice"), CmpGT, bound(30, "carol"), CmpLT))
+	})
+
+	t.Run("descending", func(t *testing.T) {
+		require.Equal(t, []int64{4, 3, 5, 1, 2}, scanIDs(bound(100, ""), CmpLE, bound(0, ""), CmpGE))
+		require.Equal(t, []int64{3, 5, 1}, scanIDs(bound(30, "carol"), CmpLE, bound(30, "bob"), CmpGE))
+		require.Equal(t, []int64{5, 1}, scanIDs(bound(30, "carol"), CmpLT, bound(25, "alice"), CmpGT))
+		require.Equal(t, []int64{3}, scanIDs(bound(30, "dave"), CmpLT, bound(30, "bob"), CmpGT))
+		require.Empty(t, scanIDs(bound(20, ""), CmpLE, bound(0, ""), CmpGE))
+		require.Empty(t, scanIDs(bound(0, ""), CmpLE, bound(100, ""), CmpGE))
+		_, err := db.Scan("users", bound(100, ""), CmpLE, bound(0, ""), CmpLE)
+		require.Error(t, err)
+	})
+
+	t.Run("record", func(t *testing.T) {
+		sc, err := db.Scan("users", bound(40, "dave"), CmpGE, bound(40, "dave"), CmpLE)
+		require.NoError(t, err)
+		defer sc.Close()
+		r, ok, err := sc.Cur()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, newTableRecord(tdef).SetInt64("id", 4).SetBlob("name", []byte("dave")).SetInt64("age", 40).Vals, r.rec.Vals)
+	})
+
+	t.Run("update_and_delete", func(t *testing.T) {
+		insert(1, "bob", 50)
+		ok, err := db.Delete("users", AnonymousRecord{"id": Int64(3)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []int64{2, 5, 4, 1}, scanIDs(bound(0, ""), CmpGE, bound(100, ""), CmpLE))
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		tx := db.Begin()
+		_, err := tx.Insert("users", AnonymousRecord{"id": Int64(6), "name": Blob([]byte("erin")), "age": Int64(20)})
+		require.NoError(t, err)
+		tx.Abort()
+		require.Equal(t, []int64{2, 5, 4, 1}, scanIDs(bound(0, ""), CmpGE, bound(100, ""), CmpLE))
+	})
+
+	t.Run("create_index", func(t *testing.T) {
+		require.NoError(t, db.CreateIndex("users", []string{"name"}))
+		require.Error(t, db.CreateIndex("users", []string{"name"}))
+		require.Error(t, db.CreateIndex("users", []string{"missing"}))
+
+		byName := func(name string) AnonymousRecord {
+			return AnonymousRecord{"name": Blob([]byte(name))}
+		}
+		require.Equal(t, []int64{1, 5, 4}, scanIDs(byName("b"), CmpGE, byName("e"), CmpLT))
+
+		// the index is maintained once created and survives reopening.
+		insert(6, "bobby", 20)
+		require.NoError(t, db.Close())
+		db, err = NewDB(db.path)
+		require.NoError(t, err)
+		require.Equal(t, []int64{1, 5, 6}, scanIDs(byName("bob"), CmpGE, byName("c"), CmpLT))
+	})
+}
+
+func TestDBUniqueIndex(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "unique.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	tdef := &tableDef{
+		Name:    "users",
+		Types:   []Type{TypeInt64, TypeBlob, TypeBlob},
+		Cols:    []string{"id", "email", "name"},
+		Pkeys:   1,
+		Indexes: [][]string{{"name"}, {"email"}},
+		Unique:  []bool{false, true},
+	}
+	require.NoError(t, db.createTable(tdef))
+	user := func(id int64, email, name string) AnonymousRecord {
+		ar := AnonymousRecord{"id": Int64(id), "name": Blob([]byte(name))}
+		if email != "" {
+			ar["email"] = Blob([]byte(email))
+		}
+		return ar
+	}
+
+	ok, err := db.Insert("users", user(1, "bob@example.com", "bob"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	t.Run("violation", func(t *testing.T) {
+		_, err := db.Insert("users", user(2, "bob@example.com", "bobby"))
+		var uv *ErrUniqueViolation
+		require.ErrorAs(t, err, &uv)
+		require.Equal(t, []string{"email"}, uv.Index)
+		require.Equal(t, []Value{Blob([]byte("bob@example.com"))}, uv.Values)
+		require.Contains(t, err.Error(), `"bob@example.com"`)
+
+		// nothing is written, including the non-unique index.
+		ok, err := db.Get("users", AnonymousRecord{"id": Int64(2)})
+		require.NoError(t, err)
+		require.False(t, ok)
+		sc, err := db.Scan("users", AnonymousRecord{"name": Blob([]byte("bobby"))}, CmpGE,
+			AnonymousRecord{"name": Blob([]byte("bobby"))}, CmpLE)
+		require.NoError(t, err)
+		require.False(t, sc.Valid())
+		sc.Close()
+
+		_, err = db.Upsert("users", user(2, "bob@example.com", "bobby"))
+		require.ErrorAs(t, err, &uv)
+	})
+
+	t.Run("same_record", func(t *testing.T) {
+		ok, err := db.Upsert("users", user(1, "bob@example.com", "robert"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		// the old value is released once the record is updated.
+		ok, err = db.Upsert("users", user(1, "robert@example.com", "robert"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = db.Insert("users", user(2, "bob@example.com", "bob"))
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("null", func(t *testing.T) {
+		for _, id := range []int64{3, 4} {
+			ok, err := db.Insert("users", user(id, "", "anonymous"))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+	})
+
+	t.Run("tx", func(t *testing.T) {
+		tx := db.Begin()
+		defer tx.Abort()
+		_, err := tx.Insert("users", user(5, "bob@example.com", "eve"))
+		var uv *ErrUniqueViolation
+		require.ErrorAs(t, err, &uv)
+		// the transaction is still usable as the failed insert wrote nothing.
+		ok, err := tx.Insert("users", user(5, "eve@example.com", "eve"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, tx.Commit())
+	})
+
+	t.Run("create", func(t *testing.T) {
+		require.NoError(t, db.createTable(&tableDef{
+			Name:  "posts",
+			Types: []Type{TypeInt64, TypeBlob},
+			Cols:  []string{"id", "slug"},
+			Pkeys: 1,
+		}))
+		for id, slug := range []string{"hello", "world", "hello"} {
+			_, err := db.Insert("posts", AnonymousRecord{"id": Int64(int64(id)), "slug": Blob([]byte(slug))})
+			require.NoError(t, err)
+		}
+		var uv *ErrUniqueViolation
+		require.ErrorAs(t, db.CreateUniqueIndex("posts", []string{"slug"}), &uv)
+		require.Equal(t, []Value{Blob([]byte("hello"))}, uv.Values)
+		require.NoError(t, db.CreateUniqueIndex("posts", []string{"slug", "id"}))
+
+		_, err := db.Delete("posts", AnonymousRecord{"id": Int64(2)})
+		require.NoError(t, err)
+		require.NoError(t, db.CreateUniqueIndex("posts", []string{"slug"}))
+		_, err = db.Insert("posts", AnonymousRecord{"id": Int64(3), "slug": Blob([]byte("world"))})
+		require.ErrorAs(t, err, &uv)
+	})
+}
+
+func TestDBDropTruncateRename(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "ddl.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// countKeys counts the keys of the KV starting with the prefix.
+	countKeys := func(prefix uint32) int {
+		tx := db.kv.Begin()
+		defer tx.Abort()
+		start := binary.BigEndian.AppendUint32(nil, prefix)
+		iter, err := tx.Seek(start, CmpGE)
+		require.NoError(t, err)
+		n := 0
+		for k, _, ok := iter.Cur(); ok && bytes.HasPrefix(k, start); k, _, ok = iter.Cur() {
+			n++
+			iter.next()
+		}
+		return n
+	}
+	setup := func(name string) *tableDef {
+		tdef := &tableDef{
+			Name:    name,
+			Types:   []Type{TypeInt64, TypeBlob, TypeBlob},
+			Cols:    []string{"id", "tag", "body"},
+			Pkeys:   1,
+			Indexes: [][]string{{"tag"}},
+		}
+		require.NoError(t, db.createTable(tdef))
+		for id := int64(0); id < 50; id++ {
+			_, err := db.Insert(name, AnonymousRecord{
+				"id":   Int64(id),
+				"tag":  Blob([]byte(fmt.Sprint(id % 3))),
+				"body": Blob(makeData(fmt.Sprint(id), 2*PageSize)),
+			})
+			require.NoError(t, err)
+		}
+		require.Equal(t, 50, countKeys(tdef.Prefix))
+		require.Equal(t, 50, countKeys(tdef.IndexPrefixes[0]))
+		return tdef
+	}
+
+	t.Run("drop", func(t *testing.T) {
+		tdef := setup("dropped")
+		require.NoError(t, db.DropTable("dropped"))
+		require.Zero(t, countKeys(tdef.Prefix))
+		require.Zero(t, countKeys(tdef.IndexPrefixes[0]))
+		_, err := db.Get("dropped", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+		require.Error(t, db.DropTable("dropped"))
+
+		// the name can be reused, with a new prefix.
+		recreated := setup("dropped")
+		require.NotEqual(t, tdef.Prefix, recreated.Prefix)
+	})
+
+	t.Run("drop_abort", func(t *testing.T) {
+		tdef := setup("kept")
+		tx := db.Begin()
+		require.NoError(t, tx.DropTable("kept"))
+		_, err := tx.Get("kept", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+		tx.Abort()
+		require.Equal(t, 50, countKeys(tdef.Prefix))
+		ok, err := db.Get("kept", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		tdef := setup("truncated")
+		require.NoError(t, db.TruncateTable("truncated"))
+		require.Zero(t, countKeys(tdef.Prefix))
+		require.Zero(t, countKeys(tdef.IndexPrefixes[0]))
+		ok, err := db.Get("truncated", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = db.Insert("truncated", AnonymousRecord{"id": Int64(1), "body": Blob([]byte("again"))})
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("many_leaves", func(t *testing.T) {
+		// the keys of the tables span many leaves, which are emptied and dropped from the tree.
+		for _, table := range []string{"truncated_many", "dropped_many"} {
+			tdef := &tableDef{
+				Name:    table,
+				Types:   []Type{TypeInt64, TypeBlob, TypeBlob},
+				Cols:    []string{"id", "tag", "body"},
+				Pkeys:   1,
+				Indexes: [][]string{{"tag"}},
+			}
+			require.NoError(t, db.createTable(tdef))
+			tx := db.Begin()
+			for id := int64(0); id < 1000; id++ {
+				_, err := tx.Insert(table, AnonymousRecord{
+					"id":  Int64(id),
+					"tag": Blob([]byte(fmt.Sprint(id % 7))),
+				})
+				require.NoError(t, err)
+			}
+			require.NoError(t, tx.Commit())
+			require.Equal(t, 1000, countKeys(tdef.Prefix))
+		}
+
+		require.NoError(t, db.TruncateTable("truncated_many"))
+		require.NoError(t, db.DropTable("dropped_many"))
+		tdef, err := db.getTableDef("truncated_many")
+		require.NoError(t, err)
+		require.Zero(t, countKeys(tdef.Prefix))
+		require.Zero(t, countKeys(tdef.IndexPrefixes[0]))
+		ok, err := db.Insert("truncated_many", AnonymousRecord{"id": Int64(1), "body": Blob([]byte("again"))})
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		tdef := setup("old_name")
+		require.Error(t, db.RenameTable("old_name", "kept"))
+		require.NoError(t, db.RenameTable("old_name", "new_name"))
+		_, err := db.Get("old_name", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+
+		clear(db.tables)
+		renamed, err := db.getTableDef("new_name")
+		require.NoError(t, err)
+		require.Equal(t, tdef.Prefix, renamed.Prefix)
+		ok, err := db.Get("new_name", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		gone, err := db.getTableDef("old_name")
+		require.NoError(t, err)
+		require.Nil(t, gone)
+	})
+}
+
+func TestDBAlterTable(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "alter.db")
+	db, err := NewDB(dbPath)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+	require.NoError(t, db.createTable(&tableDef{
+		Name:    "users",
+		Types:   []Type{TypeInt64, TypeBlob, TypeBlob},
+		Cols:    []string{"id", "name", "bio"},
+		Pkeys:   1,
+		Indexes: [][]string{{"name"}},
+	}))
+	_, err = db.Insert("users", AnonymousRecord{"id": Int64(1), "name": Blob([]byte("bob")), "bio": Blob([]byte("old"))})
+	require.NoError(t, err)
+
+	get := func(id int64) *tableRecord {
+		tdef, err := db.getTableDef("users")
+		require.NoError(t, err)
+		rec := newTableRecord(tdef).SetInt64("id", id)
+		ok, err := db.getRecord(*rec)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return rec
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Error(t, db.AlterTable("users", DropColumn("id")))
+		require.Error(t, db.AlterTable("users", DropColumn("name")))
+		require.Error(t, db.AlterTable("users", DropColumn("missing")))
+		require.Error(t, db.AlterTable("users", AddColumn("bio", TypeInt64)))
+		require.Error(t, db.AlterTable("missing", AddColumn("age", TypeInt64)))
+		require.ErrorContains(t, db.AlterTable("users", AddColumn("age", Type(99))), "unknown type 99")
+		require.ErrorContains(t, db.AlterTable("users", AddColumn("age", errorType)), "unknown type 0")
+		require.Equal(t, []string{"id", "name", "bio"}, get(1).tdef.Cols)
+	})
+
+	t.Run("add_and_drop", func(t *testing.T) {
+		require.NoError(t, db.AlterTable("users", DropColumn("bio"), AddColumn("age", TypeInt64), AddColumnDefault("role", Blob([]byte("member")))))
+		rec := get(1)
+		require.Equal(t, []string{"id", "name", "age", "role"}, rec.tdef.Cols)
+		require.Equal(t, []byte("bob"), rec.Get("name").Blob)
+		require.True(t, rec.Get("age").IsNull())
+		require.Equal(t, []byte("member"), rec.Get("role").Blob)
+
+		// the default applies to the new records inserted without the column.
+		_, err := db.Insert("users", AnonymousRecord{"id": Int64(2), "name": Blob([]byte("alice")), "age": Int64(30)})
+		require.NoError(t, err)
+		rec = get(2)
+		require.Equal(t, int64(30), rec.Get("age").I64)
+		require.Equal(t, []byte("member"), rec.Get("role").Blob)
+	})
+
+	t.Run("dropped_column_added_again", func(t *testing.T) {
+		// the record written before bio is dropped does not get its old value back.
+		require.NoError(t, db.AlterTable("users", AddColumn("bio", TypeBlob)))
+		require.True(t, get(1).Get("bio").IsNull())
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		require.NoError(t, db.UpgradeTable("users"))
+		tdef, err := db.getTableDef("users")
+		require.NoError(t, err)
+		tx := db.Begin()
+		defer tx.Abort()
+		key := new(bytes.Buffer)
+		require.NoError(t, newTableRecord(tdef).SetInt64("id", 1).serializePK(key))
+		val, _, err := tx.kv.Get(key.Bytes())
+		require.NoError(t, err)
+		version, err := readSchemaVersion(bytes.NewReader(val))
+		require.NoError(t, err)
+		require.Equal(t, tdef.Version, version)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		require.NoError(t, db.Close())
+		db, err = NewDB(dbPath)
+		require.NoError(t, err)
+		rec := get(2)
+		require.Equal(t, []byte("alice"), rec.Get("name").Blob)
+		require.Equal(t, []byte("member"), rec.Get("role").Blob)
+		require.True(t, rec.Get("bio").IsNull())
+	})
 }
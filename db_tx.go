@@ -0,0 +1,962 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// ErrUniqueViolation is returned when a write would give a record the same values as another one in a unique index.
+// Nothing is written when it is returned.
+type ErrUniqueViolation struct {
+	Table string
+	// Index is the columns of the unique index.
+	Index []string
+	// Values are the conflicting values of the columns of the index.
+	Values []Value
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	vals := make([]string, len(e.Values))
+	for i, v := range e.Values {
+		vals[i] = v.String()
+	}
+	return fmt.Sprintf("unique index %v of table %s already holds (%s)", e.Index, e.Table, strings.Join(vals, ", "))
+}
+
+// Tx is a transaction on a DB. All the writes made through it, across any number of tables,
+// are committed atomically with a single master page write.
+//
+// Only one writer transaction can be active on a DB at a time.
+type Tx struct {
+	db *DB
+	kv *KVTx
+	// tables are the table definitions read, created or modified within the transaction, nil for the dropped ones.
+	// They are only applied to the DB cache once a writer transaction commits.
+	tables map[string]*tableDef
+}
+
+// Begin starts a new transaction. It blocks until the active writer transaction, if any, is done.
+func (db *DB) Begin() *Tx {
+	return &Tx{
+		db:     db,
+		kv:     db.kv.Begin(),
+		tables: make(map[string]*tableDef),
+	}
+}
+
+// beginRead starts a read-only transaction reading the last commit.
+func (db *DB) beginRead() *Tx {
+	return &Tx{
+		db:     db,
+		kv:     db.kv.beginRead(),
+		tables: make(map[string]*tableDef),
+	}
+}
+
+// Commit makes the changes durable.
+func (tx *Tx) Commit() error {
+	if err := tx.kv.Commit(); err != nil {
+		return err
+	}
+	if tx.kv.snap != nil {
+		// the definitions read from an older commit must not replace the ones of the last commit.
+		return nil
+	}
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	for name, tdef := range tx.tables {
+		if tdef == nil {
+			delete(tx.db.tables, name)
+		} else {
+			tx.db.tables[name] = tdef
+		}
+	}
+	return nil
+}
+
+// Abort discards the changes, including the tables created within the transaction.
+func (tx *Tx) Abort() {
+	tx.kv.Abort()
+	clear(tx.tables)
+}
+
+func (tx *Tx) Insert(table string, rec AnonymousRecord) (bool, error) {
+	return tx.insert(table, rec, Insert)
+}
+
+func (tx *Tx) Upsert(table string, rec AnonymousRecord) (bool, error) {
+	return tx.insert(table, rec, Upsert)
+}
+
+func (tx *Tx) Delete(table string, ar AnonymousRecord) (bool, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return false, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table not found")
+	}
+	tr := ar.IntoTableRecord(tdef)
+	return tx.deleteRecord(*tr)
+}
+
+// deleteWhereBatch is the number of records DeleteWhere reads at a time when it cannot delete a range at once.
+var deleteWhereBatch = 256
+
+// DeleteWhere deletes the records of the table between from and to, the bounds are the ones of Tx.Scan.
+// It returns the number of records deleted.
+// A primary key range of a table without indexes is deleted with a single walk of the tree, see KVTx.DeleteRange.
+// Otherwise the records are read in batches of deleteWhereBatch, as their index keys are deleted along with them.
+// For a primary key range the records of a batch are then deleted with KVTx.DeleteRange, while for an index range
+// each record is deleted on its own, which is the slowest.
+func (tx *Tx) DeleteWhere(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) (int, error) {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return 0, err
+	}
+	lo, hi := from.intoBound(tdef), t.intoBound(tdef)
+	if fromCmp < 0 && toCmp > 0 {
+		// the records are the same either way, they are deleted in ascending order.
+		lo, fromCmp, hi, toCmp = hi, toCmp, lo, fromCmp
+	}
+	index, err := scanIndex(*lo, *hi)
+	if err != nil {
+		return 0, err
+	}
+	if index < 0 && len(tdef.Indexes) == 0 {
+		return tx.deletePKRange(*lo, fromCmp, *hi, toCmp)
+	}
+
+	n := 0
+	for {
+		// the scanner does not survive the writes, each batch is read from the start of the range
+		// which the previous batches are no longer in.
+		recs, err := tx.scanRecords(*lo, fromCmp, *hi, toCmp, deleteWhereBatch)
+		if err != nil || len(recs) == 0 {
+			return n, err
+		}
+		if index < 0 {
+			for _, rec := range recs {
+				if err := tx.updateIndexes(rec, nil); err != nil {
+					return n, err
+				}
+			}
+			if _, err := tx.deletePKRange(*lo, fromCmp, *recs[len(recs)-1], CmpLE); err != nil {
+				return n, err
+			}
+		} else {
+			for _, rec := range recs {
+				if _, err := tx.deleteRecord(*rec); err != nil {
+					return n, err
+				}
+			}
+		}
+		n += len(recs)
+	}
+}
+
+// scanRecords returns up to n records between from and to, see Tx.scan.
+func (tx *Tx) scanRecords(from tableRecord, fromCmp Cmp, t tableRecord, toCmp Cmp, n int) ([]*tableRecord, error) {
+	sc, err := tx.scan(from, fromCmp, t, toCmp)
+	if err != nil {
+		return nil, err
+	}
+	var recs []*tableRecord
+	for row, err := range sc.All() {
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, row.rec)
+		if len(recs) == n {
+			break
+		}
+	}
+	return recs, nil
+}
+
+// deletePKRange deletes the records whose primary key is between from and to.
+func (tx *Tx) deletePKRange(from tableRecord, fromCmp Cmp, t tableRecord, toCmp Cmp) (int, error) {
+	if fromCmp < 0 && toCmp > 0 {
+		from, fromCmp, t, toCmp = t, toCmp, from, fromCmp
+	}
+	if !(fromCmp > 0 && toCmp < 0) {
+		return 0, fmt.Errorf("invalid range")
+	}
+	start, end := new(bytes.Buffer), new(bytes.Buffer)
+	if err := from.serializePK(start); err != nil {
+		return 0, fmt.Errorf("serializing from key: %w", err)
+	}
+	if err := t.serializePK(end); err != nil {
+		return 0, fmt.Errorf("serializing to key: %w", err)
+	}
+	// the smallest key greater than a key is the key followed by a zero byte.
+	if fromCmp == CmpGT {
+		start.WriteByte(0)
+	}
+	if toCmp == CmpLE {
+		end.WriteByte(0)
+	}
+	return tx.kv.DeleteRange(start.Bytes(), end.Bytes())
+}
+
+// Get looks up the record with the primary key of ar. If it is found ar is filled with
+// every column of the record, the null ones included.
+func (tx *Tx) Get(table string, ar AnonymousRecord) (bool, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return false, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table not found")
+	}
+	tr := ar.IntoTableRecord(tdef)
+	ok, err := tx.getRecord(*tr)
+	if ok {
+		ar.fill(tr)
+	}
+	return ok, err
+}
+
+// Scan returns a scanner over the records of the table between from and to.
+// The bounds hold the columns the records are compared on: the primary key, or the columns of an index
+// to scan the index instead, see scanIndex. The other columns of the bounds are ignored.
+// The records are in ascending order if fromCmp is CmpGE or CmpGT and toCmp is CmpLE or CmpLT,
+// and in descending order if fromCmp is CmpLE or CmpLT and toCmp is CmpGE or CmpGT.
+func (tx *Tx) Scan(table string, from AnonymousRecord, fromCmp Cmp, t AnonymousRecord, toCmp Cmp) (*Scanner, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return nil, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return tx.scan(*from.intoBound(tdef), fromCmp, *t.intoBound(tdef), toCmp)
+}
+
+// CreateTable creates a table with the schema, see Schema.
+func (tx *Tx) CreateTable(schema *Schema) error {
+	tdef, err := schema.tableDef()
+	if err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+	return tx.createTable(tdef)
+}
+
+// createTable allocates a prefix for the table and each of its indexes and stores its definition.
+// All the writes belong to the transaction so a prefix is never consumed without the table being created.
+func (tx *Tx) createTable(tdef *tableDef) error {
+	if err := tdef.Validate(); err != nil {
+		return fmt.Errorf("invalid table def: %w", err)
+	}
+
+	// check if the table exist
+	tdefRecord := newTableRecord(&tableDefsTable).SetBlob("name", []byte(tdef.Name))
+	if ok, err := tx.getRecord(*tdefRecord); err != nil {
+		return fmt.Errorf("retreiving table definition: %w", err)
+	} else if ok {
+		return fmt.Errorf("table already exists")
+	}
+
+	var err error
+	if tdef.Prefix, err = tx.allocPrefix(); err != nil {
+		return err
+	}
+	tdef.IndexPrefixes = make([]uint32, len(tdef.Indexes))
+	for i := range tdef.Indexes {
+		if tdef.IndexPrefixes[i], err = tx.allocPrefix(); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.putTableDef(tdef, Insert); err != nil {
+		return err
+	}
+	tx.tables[tdef.Name] = tdef
+	return nil
+}
+
+// CreateIndex adds an index on the columns to the table and fills it with the records of the table.
+func (tx *Tx) CreateIndex(table string, cols []string) error {
+	return tx.createIndex(table, cols, false)
+}
+
+// CreateUniqueIndex adds a unique index on the columns to the table, see CreateIndex.
+// It fails with ErrUniqueViolation if the records of the table already violate it.
+func (tx *Tx) CreateUniqueIndex(table string, cols []string) error {
+	return tx.createIndex(table, cols, true)
+}
+
+func (tx *Tx) createIndex(table string, cols []string, unique bool) error {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return fmt.Errorf("table not found: %s", table)
+	}
+
+	// the definition is copied as the cached one can be in use by other transactions.
+	updated := *tdef
+	updated.Indexes = append(slices.Clone(tdef.Indexes), slices.Clone(cols))
+	updated.Unique = make([]bool, len(updated.Indexes))
+	copy(updated.Unique, tdef.Unique)
+	updated.Unique[len(updated.Indexes)-1] = unique
+	if err := updated.Validate(); err != nil {
+		return fmt.Errorf("invalid index: %w", err)
+	}
+	prefix, err := tx.allocPrefix()
+	if err != nil {
+		return err
+	}
+	updated.IndexPrefixes = append(slices.Clone(tdef.IndexPrefixes), prefix)
+	if err := tx.putTableDef(&updated, Update); err != nil {
+		return err
+	}
+
+	// the table is sought again after each record as the iterator does not survive the writes.
+	index := len(updated.Indexes) - 1
+	key := binary.BigEndian.AppendUint32(nil, updated.Prefix)
+	for cmp := CmpGE; ; cmp = CmpGT {
+		iter, err := tx.kv.Seek(key, cmp)
+		if err != nil {
+			return err
+		}
+		k, _, ok := iter.Cur()
+		if !ok || !bytes.HasPrefix(k, key[:4]) {
+			break
+		}
+		key = bytes.Clone(k)
+		rec := newTableRecord(&updated)
+		if err := rec.deserializePK(bytes.NewReader(key)); err != nil {
+			return fmt.Errorf("%w: decoding primary key: %v", ErrCorrupt, err)
+		}
+		if _, err := tx.getRecord(*rec); err != nil {
+			return err
+		}
+		if err := tx.checkUnique(*rec, index); err != nil {
+			return err
+		}
+		if err := tx.insertIndexKey(*rec, index); err != nil {
+			return err
+		}
+	}
+	tx.tables[table] = &updated
+	return nil
+}
+
+// allocPrefix returns the next free B-tree key prefix from @meta.next_prefix.
+func (tx *Tx) allocPrefix() (uint32, error) {
+	metaRecord := newTableRecord(&metaDataTable).SetBlob("key", []byte("next_prefix"))
+	ok, err := tx.getRecord(*metaRecord)
+	if err != nil {
+		return 0, fmt.Errorf("retreiving next_prefix: %w", err)
+	}
+	var prefix uint32
+	if !ok {
+		prefix = tableInitPrefix
+		metaRecord.SetBlob("value", make([]byte, 4))
+	} else {
+		prefix = binary.LittleEndian.Uint32(metaRecord.Get("value").Blob)
+	}
+
+	// increment the next_prefix
+	binary.LittleEndian.PutUint32(metaRecord.Get("value").Blob, prefix+1)
+	if _, err := tx.insertRecord(*metaRecord, Upsert); err != nil {
+		return 0, fmt.Errorf("updating next_prefix: %w", err)
+	}
+	return prefix, nil
+}
+
+// putTableDef stores the table definition in @table.
+func (tx *Tx) putTableDef(tdef *tableDef, mode InsertMode) error {
+	buf := new(bytes.Buffer)
+	if err := tdef.Serialize(buf); err != nil {
+		return fmt.Errorf("serializing table definition: %w", err)
+	}
+	tdefRecord := newTableRecord(&tableDefsTable).
+		SetBlob("name", []byte(tdef.Name)).
+		SetBlob("def", buf.Bytes())
+	if _, err := tx.insertRecord(*tdefRecord, mode); err != nil {
+		return fmt.Errorf("storing table definition: %w", err)
+	}
+	return nil
+}
+
+func (tx *Tx) insert(table string, ar AnonymousRecord, mode InsertMode) (bool, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return false, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return false, fmt.Errorf("table not found")
+	}
+	tr := ar.IntoTableRecord(tdef)
+	return tx.insertRecord(*tr, mode)
+}
+
+// DropTable deletes the table definition and every record and index key of the table.
+func (tx *Tx) DropTable(table string) error {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return err
+	}
+	if err := tx.truncate(tdef); err != nil {
+		return err
+	}
+	if _, err := tx.deleteRecord(*newTableRecord(&tableDefsTable).SetBlob("name", []byte(table))); err != nil {
+		return fmt.Errorf("deleting table definition: %w", err)
+	}
+	tx.tables[table] = nil
+	return nil
+}
+
+// TruncateTable deletes every record and index key of the table, the table definition is kept.
+func (tx *Tx) TruncateTable(table string) error {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return err
+	}
+	return tx.truncate(tdef)
+}
+
+// RenameTable renames the table. The records are left untouched as they are keyed by the table prefix.
+func (tx *Tx) RenameTable(table, newName string) error {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return err
+	}
+	if existing, err := tx.getTableDef(newName); err != nil {
+		return fmt.Errorf("getting table definition: %w", err)
+	} else if existing != nil {
+		return fmt.Errorf("table already exists: %s", newName)
+	}
+
+	// the definition is copied as the cached one can be in use by other transactions.
+	renamed := *tdef
+	renamed.Name = newName
+	if err := renamed.Validate(); err != nil {
+		return fmt.Errorf("invalid table def: %w", err)
+	}
+	if _, err := tx.deleteRecord(*newTableRecord(&tableDefsTable).SetBlob("name", []byte(table))); err != nil {
+		return fmt.Errorf("deleting table definition: %w", err)
+	}
+	if err := tx.putTableDef(&renamed, Insert); err != nil {
+		return err
+	}
+	tx.tables[table] = nil
+	tx.tables[newName] = &renamed
+	return nil
+}
+
+// Alteration is a change of the columns of a table, see AddColumn, AddColumnDefault and DropColumn.
+type Alteration struct {
+	col  string
+	drop bool
+	typ  Type
+	def  *Value
+}
+
+// AddColumn adds a nullable column, it is null for the existing records.
+func AddColumn(col string, typ Type) Alteration {
+	return Alteration{col: col, typ: typ}
+}
+
+// AddColumnDefault adds a column with a default value, which is the value of the existing records
+// and of the records inserted without the column.
+func AddColumnDefault(col string, def Value) Alteration {
+	return Alteration{col: col, typ: def.Type, def: &def}
+}
+
+// DropColumn drops a non-key column that is not indexed.
+func DropColumn(col string) Alteration {
+	return Alteration{col: col, drop: true}
+}
+
+// AlterTable applies the alterations to the table as a new schema version.
+// The existing records are not rewritten, they are upgraded when they are read, see UpgradeTable.
+func (tx *Tx) AlterTable(table string, alterations ...Alteration) error {
+	if len(alterations) == 0 {
+		return nil
+	}
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return err
+	}
+
+	// the definition is copied as the cached one can be in use by other transactions.
+	altered := *tdef
+	altered.Cols = slices.Clone(tdef.Cols)
+	altered.Types = slices.Clone(tdef.Types)
+	altered.Defaults = maps.Clone(tdef.Defaults)
+	altered.Schemas = append(slices.Clone(tdef.Schemas), tableSchema{
+		Cols:  slices.Clone(tdef.Cols[tdef.Pkeys:]),
+		Types: slices.Clone(tdef.Types[tdef.Pkeys:]),
+	})
+	altered.Version++
+	for _, alt := range alterations {
+		idx := slices.Index(altered.Cols, alt.col)
+		if !alt.drop {
+			if idx >= 0 {
+				return fmt.Errorf("column already exists: %s", alt.col)
+			}
+			altered.Cols = append(altered.Cols, alt.col)
+			altered.Types = append(altered.Types, alt.typ)
+			if alt.def != nil {
+				if altered.Defaults == nil {
+					altered.Defaults = make(map[string]Value)
+				}
+				altered.Defaults[alt.col] = *alt.def
+			}
+			continue
+		}
+		if idx < 0 {
+			return fmt.Errorf("column not found: %s", alt.col)
+		}
+		if idx < altered.Pkeys {
+			return fmt.Errorf("column %s is part of the primary key", alt.col)
+		}
+		for _, index := range altered.Indexes {
+			if slices.Contains(index, alt.col) {
+				return fmt.Errorf("column %s is indexed by %v", alt.col, index)
+			}
+		}
+		altered.Cols = slices.Delete(altered.Cols, idx, idx+1)
+		altered.Types = slices.Delete(altered.Types, idx, idx+1)
+		delete(altered.Defaults, alt.col)
+	}
+	if err := altered.Validate(); err != nil {
+		return fmt.Errorf("invalid table def: %w", err)
+	}
+	if err := tx.putTableDef(&altered, Update); err != nil {
+		return err
+	}
+	tx.tables[table] = &altered
+	return nil
+}
+
+// UpgradeTable rewrites the records of the table written with a previous schema version.
+func (tx *Tx) UpgradeTable(table string) error {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return err
+	}
+	// the table is sought again after each record as the iterator does not survive the writes.
+	key := binary.BigEndian.AppendUint32(nil, tdef.Prefix)
+	for cmp := CmpGE; ; cmp = CmpGT {
+		iter, err := tx.kv.Seek(key, cmp)
+		if err != nil {
+			return err
+		}
+		k, _, ok := iter.Cur()
+		if !ok || !bytes.HasPrefix(k, key[:4]) {
+			return nil
+		}
+		key = bytes.Clone(k)
+		val, _, err := tx.kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if version, err := readSchemaVersion(bytes.NewReader(val)); err != nil {
+			return err
+		} else if version == tdef.Version {
+			continue
+		}
+		rec := newTableRecord(tdef)
+		if err := rec.deserializeValues(bytes.NewReader(val)); err != nil {
+			return fmt.Errorf("decoding values: %w", err)
+		}
+		upgraded := new(bytes.Buffer)
+		if err := rec.serializeValues(upgraded); err != nil {
+			return fmt.Errorf("serializing values: %w", err)
+		}
+		if _, err := tx.kv.Update(key, upgraded.Bytes(), Update); err != nil {
+			return err
+		}
+	}
+}
+
+// truncate deletes the keys of the table and of its indexes.
+func (tx *Tx) truncate(tdef *tableDef) error {
+	if err := tx.deletePrefix(tdef.Prefix); err != nil {
+		return err
+	}
+	for _, prefix := range tdef.IndexPrefixes {
+		if err := tx.deletePrefix(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletePrefix deletes every key starting with the prefix.
+func (tx *Tx) deletePrefix(prefix uint32) error {
+	start := binary.BigEndian.AppendUint32(nil, prefix)
+	_, err := tx.kv.DeleteRange(start, prefixSuccessor(start))
+	return err
+}
+
+// mustGetTableDef is getTableDef failing if the table does not exist.
+func (tx *Tx) mustGetTableDef(table string) (*tableDef, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return nil, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	return tdef, nil
+}
+
+// getTableDef looks up the table definition from the tables read, created or modified within the transaction,
+// then from the DB cache and lastly from the @table table.
+// The DB cache holds the definitions of the last commit, so a read transaction, which may read an older one,
+// skips it. The definitions read are kept in tx.tables, the writer fills the cache with them on commit.
+func (tx *Tx) getTableDef(table string) (*tableDef, error) {
+	if tdef, ok := tx.tables[table]; ok {
+		return tdef, nil
+	}
+	if tx.kv.snap == nil {
+		tx.db.mu.RLock()
+		tdef, ok := tx.db.tables[table]
+		tx.db.mu.RUnlock()
+		if ok {
+			return tdef, nil
+		}
+	}
+	rec := newTableRecord(&tableDefsTable).SetBlob("name", []byte(table))
+	ok, err := tx.getRecord(*rec)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	tdef := new(tableDef)
+	err = json.Unmarshal(rec.Get("def").Blob, tdef)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshaling: %w", err)
+	}
+	tx.tables[table] = tdef
+	return tdef, nil
+}
+
+func (tx *Tx) getRecord(rec tableRecord) (bool, error) {
+	if err := rec.ValidatePK(); err != nil {
+		return false, err
+	}
+
+	key := new(bytes.Buffer)
+	if err := rec.serializePK(key); err != nil {
+		return false, fmt.Errorf("serializing primary key: %w", err)
+	}
+	val, ok, err := tx.kv.Get(key.Bytes())
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+
+	valBuf := bytes.NewBuffer(val)
+	if err := rec.deserializeValues(valBuf); err != nil {
+		return false, fmt.Errorf("decoding values: %w", err)
+	}
+
+	return true, nil
+}
+
+func (tx *Tx) deleteRecord(rec tableRecord) (bool, error) {
+	if err := rec.ValidatePK(); err != nil {
+		return false, err
+	}
+	key := new(bytes.Buffer)
+	if err := rec.serializePK(key); err != nil {
+		return false, fmt.Errorf("serializing primary key: %w", err)
+	}
+	if len(rec.tdef.Indexes) == 0 {
+		return tx.kv.Del(key.Bytes())
+	}
+
+	// the indexed values are read to find the index keys to delete.
+	old := rec.clonePK()
+	ok, err := tx.getRecord(*old)
+	if err != nil || !ok {
+		return false, err
+	}
+	if _, err := tx.kv.Del(key.Bytes()); err != nil {
+		return false, err
+	}
+	return true, tx.updateIndexes(old, nil)
+}
+
+func (tx *Tx) insertRecord(rec tableRecord, mode InsertMode) (bool, error) {
+	if err := rec.validate(); err != nil {
+		return false, err
+	}
+	key := new(bytes.Buffer)
+	if err := rec.serializePK(key); err != nil {
+		return false, fmt.Errorf("serializing primary key: %w", err)
+	}
+	val := new(bytes.Buffer)
+	if err := rec.serializeValues(val); err != nil {
+		return false, fmt.Errorf("serializing non-primary key: %w", err)
+	}
+	if len(rec.tdef.Indexes) == 0 {
+		return tx.kv.Update(key.Bytes(), val.Bytes(), mode)
+	}
+
+	// the old record, if any, is read to find the index keys to replace.
+	old := rec.clonePK()
+	exists, err := tx.getRecord(*old)
+	if err != nil {
+		return false, err
+	}
+	if (mode == Insert && exists) || (mode == Update && !exists) {
+		return false, nil
+	}
+	// the unique indexes are checked before anything is written.
+	for i := range rec.tdef.Indexes {
+		if err := tx.checkUnique(rec, i); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.kv.Update(key.Bytes(), val.Bytes(), Upsert); err != nil {
+		return false, err
+	}
+	if !exists {
+		old = nil
+	}
+	return true, tx.updateIndexes(old, &rec)
+}
+
+// updateIndexes replaces the index keys of the record before the write with the ones after it.
+// before is nil when the record is inserted and after is nil when it is deleted.
+func (tx *Tx) updateIndexes(before, after *tableRecord) error {
+	tdef := before
+	if tdef == nil {
+		tdef = after
+	}
+	for i := range tdef.tdef.Indexes {
+		var oldKey, newKey []byte
+		if before != nil {
+			buf := new(bytes.Buffer)
+			if err := before.serializeIndexKey(buf, i); err != nil {
+				return fmt.Errorf("serializing index key: %w", err)
+			}
+			oldKey = buf.Bytes()
+		}
+		if after != nil {
+			buf := new(bytes.Buffer)
+			if err := after.serializeIndexKey(buf, i); err != nil {
+				return fmt.Errorf("serializing index key: %w", err)
+			}
+			newKey = buf.Bytes()
+		}
+		if bytes.Equal(oldKey, newKey) {
+			continue
+		}
+		if oldKey != nil {
+			if ok, err := tx.kv.Del(oldKey); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("%w: index key %q not found", ErrCorrupt, oldKey)
+			}
+		}
+		if newKey != nil {
+			if err := tx.insertKey(newKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkUnique fails with ErrUniqueViolation if the ith index is unique and holds the values
+// of the record for another record. Null values never conflict.
+func (tx *Tx) checkUnique(rec tableRecord, i int) (err error) {
+	if !rec.tdef.isUnique(i) || !rec.indexSet(i) {
+		return nil
+	}
+	defer recoverPanic(&err)
+	bound := new(bytes.Buffer)
+	if err := rec.serializeIndexBound(bound, i); err != nil {
+		return fmt.Errorf("serializing index key: %w", err)
+	}
+	own := new(bytes.Buffer)
+	if err := rec.serializeIndexKey(own, i); err != nil {
+		return fmt.Errorf("serializing index key: %w", err)
+	}
+	iter, err := tx.kv.Seek(bound.Bytes(), CmpGE)
+	if err != nil {
+		return err
+	}
+	// the keys holding the values are contiguous, at most one of them is not the record's own.
+	for n := 0; n < 2; n++ {
+		k, _, ok := iter.Cur()
+		if !ok || !bytes.HasPrefix(k, bound.Bytes()) {
+			return nil
+		}
+		if !bytes.Equal(k, own.Bytes()) {
+			vals := make([]Value, 0, len(rec.tdef.Indexes[i]))
+			for _, col := range rec.tdef.indexCols(i) {
+				vals = append(vals, rec.Vals[col])
+			}
+			return &ErrUniqueViolation{Table: rec.tdef.Name, Index: rec.tdef.Indexes[i], Values: vals}
+		}
+		iter.next()
+	}
+	return nil
+}
+
+// insertIndexKey inserts the key of the record in the ith index.
+func (tx *Tx) insertIndexKey(rec tableRecord, i int) error {
+	key := new(bytes.Buffer)
+	if err := rec.serializeIndexKey(key, i); err != nil {
+		return fmt.Errorf("serializing index key: %w", err)
+	}
+	return tx.insertKey(key.Bytes())
+}
+
+// insertKey inserts an index key, which holds no value.
+func (tx *Tx) insertKey(key []byte) error {
+	ok, err := tx.kv.Update(key, nil, Insert)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: index key %q already exists", ErrCorrupt, key)
+	}
+	return nil
+}
+
+// scan returns a scanner over the records between from and to, see scanIndex for the key it ranges over and Tx.Scan
+// for the order.
+func (tx *Tx) scan(from tableRecord, fromCmp Cmp, t tableRecord, toCmp Cmp) (_ *Scanner, err error) {
+	desc := fromCmp < 0 && toCmp > 0
+	if !(fromCmp > 0 && toCmp < 0) && !desc {
+		return nil, fmt.Errorf("invalid range")
+	}
+
+	index, err := scanIndex(from, t)
+	if err != nil {
+		return nil, err
+	}
+	fromKey := new(bytes.Buffer)
+	toKey := new(bytes.Buffer)
+	if index < 0 {
+		if err := from.serializePK(fromKey); err != nil {
+			return nil, fmt.Errorf("serializing from key: %w", err)
+		}
+		if err := t.serializePK(toKey); err != nil {
+			return nil, fmt.Errorf("serializing to key: %w", err)
+		}
+	} else {
+		if err := from.serializeIndexBound(fromKey, index); err != nil {
+			return nil, fmt.Errorf("serializing from key: %w", err)
+		}
+		if err := t.serializeIndexBound(toKey, index); err != nil {
+			return nil, fmt.Errorf("serializing to key: %w", err)
+		}
+	}
+
+	seekKey, seekCmp := fromKey.Bytes(), fromCmp
+	if index >= 0 && (fromCmp == CmpGT || fromCmp == CmpLE) {
+		// the index keys extend the bound with the primary key, the ones starting with the bound are equal to it
+		// and are all less than its successor.
+		seekKey = prefixSuccessor(fromKey.Bytes())
+		assert(seekKey != nil, "index bound %q has no successor", fromKey.Bytes())
+		if fromCmp == CmpGT {
+			seekCmp = CmpGE
+		} else {
+			seekCmp = CmpLT
+		}
+	}
+	iter, err := tx.kv.Seek(seekKey, seekCmp)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := &Scanner{
+		kv:    tx.kv.kv,
+		tdef:  t.tdef,
+		index: index,
+		toKey: toKey.Bytes(),
+		toCmp: toCmp,
+		desc:  desc,
+		iter:  iter,
+	}
+	return scanner, nil
+}
+
+// ScanAll returns a scanner over every record of the table, in the primary key order.
+func (tx *Tx) ScanAll(table string) (*Scanner, error) {
+	return tx.ScanPrefix(table)
+}
+
+// ScanPrefix returns a scanner over the records of the table whose first primary key columns are equal to pk,
+// in the primary key order. pk holds at most as many values as the primary key has columns, none of them null.
+func (tx *Tx) ScanPrefix(table string, pk ...Value) (*Scanner, error) {
+	tdef, err := tx.getTableDef(table)
+	if err != nil {
+		return nil, fmt.Errorf("getting table definition: %w", err)
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	if len(pk) > tdef.Pkeys {
+		return nil, fmt.Errorf("expected at most %d primary key values got %d", tdef.Pkeys, len(pk))
+	}
+	rec := newTableRecord(tdef)
+	copy(rec.Vals, pk)
+	prefix := new(bytes.Buffer)
+	if err := rec.serializePKPrefix(prefix, len(pk)); err != nil {
+		return nil, fmt.Errorf("serializing prefix: %w", err)
+	}
+	return tx.scanPrefix(tdef, prefix.Bytes())
+}
+
+// scanTable returns a scanner over every record of the table, in the primary key order.
+func (tx *Tx) scanTable(tdef *tableDef) (*Scanner, error) {
+	return tx.scanPrefix(tdef, binary.BigEndian.AppendUint32(nil, tdef.Prefix))
+}
+
+// scanPrefix returns a scanner over the records whose key starts with the prefix, in the primary key order.
+func (tx *Tx) scanPrefix(tdef *tableDef, prefix []byte) (*Scanner, error) {
+	toKey := prefixSuccessor(prefix)
+	assert(toKey != nil, "prefix %q has no successor", prefix)
+	iter, err := tx.kv.Seek(prefix, CmpGE)
+	if err != nil {
+		return nil, err
+	}
+	return &Scanner{
+		kv:    tx.kv.kv,
+		tdef:  tdef,
+		index: -1,
+		toKey: toKey,
+		toCmp: CmpLT,
+		iter:  iter,
+	}, nil
+}
+
+// scanIndex returns the index to range over between the bounds, or -1 for the primary key.
+// The primary key is used if it is set in both bounds, otherwise the first index whose columns are.
+func scanIndex(from, to tableRecord) (int, error) {
+	fromErr, toErr := from.ValidatePK(), to.ValidatePK()
+	if fromErr == nil && toErr == nil {
+		return -1, nil
+	}
+	for i := range from.tdef.Indexes {
+		if from.indexSet(i) && to.indexSet(i) {
+			return i, nil
+		}
+	}
+	if fromErr != nil {
+		return -1, fmt.Errorf("from : %w", fromErr)
+	}
+	return -1, fmt.Errorf("to : %w", toErr)
+}
@@ -0,0 +1,126 @@
+package deadsimpledb
+
+import (
+	"path"
+	"sync"
+	"testing"
+
+	testAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTx(t *testing.T) {
+	usersTdef := func() *tableDef {
+		return &tableDef{
+			Name:  "users",
+			Types: []Type{TypeInt64, TypeBlob},
+			Cols:  []string{"id", "name"},
+			Pkeys: 1,
+		}
+	}
+	postsTdef := func() *tableDef {
+		return &tableDef{
+			Name:  "posts",
+			Types: []Type{TypeInt64, TypeInt64},
+			Cols:  []string{"id", "user_id"},
+			Pkeys: 1,
+		}
+	}
+	setupDB := func(t *testing.T) (*DB, string) {
+		dbPath := path.Join(t.TempDir(), "tx.db")
+		db, err := NewDB(dbPath)
+		require.NoError(t, err)
+		return db, dbPath
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		db, dbPath := setupDB(t)
+
+		tx := db.Begin()
+		require.NoError(t, tx.createTable(usersTdef()))
+		require.NoError(t, tx.createTable(postsTdef()))
+		ok, err := tx.Insert("users", AnonymousRecord{"id": Int64(1), "name": Blob([]byte("bob"))})
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = tx.Insert("posts", AnonymousRecord{"id": Int64(1), "user_id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, tx.Commit())
+		require.NoError(t, db.Close())
+
+		db, err = NewDB(dbPath)
+		require.NoError(t, err)
+		defer db.Close()
+		ok, err = db.Get("users", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = db.Get("posts", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		db, _ := setupDB(t)
+		defer db.Close()
+		require.NoError(t, db.createTable(usersTdef()))
+
+		tx := db.Begin()
+		posts := postsTdef()
+		require.NoError(t, tx.createTable(posts))
+		ok, err := tx.Insert("users", AnonymousRecord{"id": Int64(1), "name": Blob([]byte("bob"))})
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = tx.Get("users", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.True(t, ok)
+		tx.Abort()
+
+		ok, err = db.Get("users", AnonymousRecord{"id": Int64(1)})
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, err = db.Get("posts", AnonymousRecord{"id": Int64(1)})
+		require.Error(t, err)
+		require.NotContains(t, db.tables, "posts")
+
+		// the prefix allocated by the aborted transaction is handed out again
+		retry := postsTdef()
+		require.NoError(t, db.createTable(retry))
+		require.Equal(t, posts.Prefix, retry.Prefix)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		db, _ := setupDB(t)
+		defer db.Close()
+		require.NoError(t, db.createTable(usersTdef()))
+
+		const writers, readers, nrecs = 2, 4, 100
+		var wg sync.WaitGroup
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := w; i < nrecs; i += writers {
+					_, err := db.Insert("users", AnonymousRecord{"id": Int64(int64(i)), "name": Blob([]byte("bob"))})
+					testAssert.NoError(t, err)
+				}
+			}()
+		}
+		for r := 0; r < readers; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < nrecs; i++ {
+					_, err := db.Get("users", AnonymousRecord{"id": Int64(int64(i))})
+					testAssert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := 0; i < nrecs; i++ {
+			ok, err := db.Get("users", AnonymousRecord{"id": Int64(int64(i))})
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+	})
+}
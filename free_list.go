@@ -7,15 +7,15 @@ import (
 
 var (
 	freeListNodeType   uint16 = 3
-	freeListHeaderSize int    = 2 + 2 + 8 + 8
+	freeListHeaderSize int    = 2 + 2 + 4 + 8 + 8
 	// freeListCap is the maximum number of pointers a free list node can store.
 	freeListCap int
 )
 
 // Free list node format:
-// | header 					| body
-// | type | size | total (only for head) | next | pointers
-// | 2B   | 2B   | 8B     		 | 8B 	| size * 8B
+// | header 					           | body
+// | type | size | checksum | total (only for head) | next | pointers
+// | 2B   | 2B   | 4B       | 8B     		     | 8B   | size * 8B
 
 // Free list disk layout
 // head -> node1 -> node2 -> ... -> nodeN
@@ -43,11 +43,11 @@ func (n freeListNode) setSize(size uint16) {
 }
 
 func (n freeListNode) next() uint64 {
-	return binary.LittleEndian.Uint64(n.data[12:])
+	return binary.LittleEndian.Uint64(n.data[16:])
 }
 
 func (n freeListNode) setNext(next uint64) {
-	binary.LittleEndian.PutUint64(n.data[12:], next)
+	binary.LittleEndian.PutUint64(n.data[16:], next)
 }
 
 func (n freeListNode) getPtr(idx int) uint64 {
@@ -61,11 +61,11 @@ func (n freeListNode) setPtr(idx int, ptr uint64) {
 }
 
 func (n freeListNode) getTotal() uint64 {
-	return binary.LittleEndian.Uint64(n.data[4:])
+	return binary.LittleEndian.Uint64(n.data[8:])
 }
 
 func (n freeListNode) setTotal(total uint64) {
-	binary.LittleEndian.PutUint64(n.data[4:], total)
+	binary.LittleEndian.PutUint64(n.data[8:], total)
 }
 
 type freeList struct {
@@ -73,19 +73,63 @@ type freeList struct {
 	pending []uint64
 	freed   []uint64
 	popn    int
-	cache   map[uint64]bool
-	size    int
+	// popped are the pages popped since the last write, in pop order.
+	// They are kept so that the pops can be undone by rollback.
+	popped []uint64
+	cache  map[uint64]bool
+	size   int
+
+	// version is the number of writes, one per commit, since the free list was read.
+	version uint64
+	// pins counts the live snapshots by the version they read.
+	// Pages freed after the oldest of them can still be reached by it, so they are not reused.
+	pins map[uint64]int
+	// freedAt is the version that freed a page. It is only recorded while there are pins,
+	// a page freed while there was none cannot be reached by any snapshot.
+	freedAt map[uint64]uint64
 
 	pager Pager
 }
 
 func newFreeList(pager Pager) *freeList {
 	return &freeList{
-		cache: make(map[uint64]bool),
-		pager: pager,
+		cache:   make(map[uint64]bool),
+		pins:    make(map[uint64]int),
+		freedAt: make(map[uint64]uint64),
+		pager:   pager,
 	}
 }
 
+// pin stops the pages reachable as of the current version from being reused and returns the version.
+func (fl *freeList) pin() uint64 {
+	fl.pins[fl.version]++
+	return fl.version
+}
+
+// unpin releases a version returned by pin.
+func (fl *freeList) unpin(version uint64) {
+	assert(fl.pins[version] > 0, "version %d is not pinned", version)
+	fl.pins[version]--
+	if fl.pins[version] == 0 {
+		delete(fl.pins, version)
+	}
+	if len(fl.pins) == 0 {
+		clear(fl.freedAt)
+	}
+}
+
+// pinned returns true if the page is freed after the oldest pinned version.
+func (fl *freeList) pinned(ptr uint64) bool {
+	if len(fl.pins) == 0 {
+		return false
+	}
+	oldest := fl.version
+	for version := range fl.pins {
+		oldest = min(oldest, version)
+	}
+	return fl.freedAt[ptr] > oldest
+}
+
 func (fl *freeList) freeCount() int {
 	return len(fl.freed)
 }
@@ -95,17 +139,39 @@ func (fl *freeList) pendingCount() int {
 }
 
 // pop returns the next free page from the free list.
+// The pages are popped in the reverse order they are freed, so once the next page is pinned
+// by a snapshot no page can be popped until the snapshot is released.
 func (fl *freeList) pop() (uint64, bool) {
-	if len(fl.freed) == 0 {
+	if len(fl.freed) == 0 || fl.pinned(fl.freed[len(fl.freed)-1]) {
 		return 0, false
 	}
 	ptr := fl.freed[len(fl.freed)-1]
 	fl.freed = fl.freed[:len(fl.freed)-1]
 	fl.popn++
+	fl.popped = append(fl.popped, ptr)
 	delete(fl.cache, ptr)
+	delete(fl.freedAt, ptr)
 	return ptr, true
 }
 
+// rollback undoes every pop and free since the last write.
+func (fl *freeList) rollback() {
+	// pending must be dropped from the cache first as a page can be popped
+	// and then freed again within the same transaction.
+	for _, ptr := range fl.pending {
+		delete(fl.cache, ptr)
+	}
+	fl.pending = fl.pending[:0]
+
+	for i := len(fl.popped) - 1; i >= 0; i-- {
+		ptr := fl.popped[i]
+		fl.freed = append(fl.freed, ptr)
+		fl.cache[ptr] = true
+	}
+	fl.popn -= len(fl.popped)
+	fl.popped = fl.popped[:0]
+}
+
 func (fl *freeList) free(ptr uint64) {
 	if freed := fl.cache[ptr]; freed {
 		panic(fmt.Sprintf("double free: %d", ptr))
@@ -131,6 +197,7 @@ func (fl *freeList) read(head uint64) {
 	fl.freed = make([]uint64, fl.size)
 	fl.cache = make(map[uint64]bool)
 	fl.popn = 0
+	fl.popped = fl.popped[:0]
 
 	freed := fl.freed
 
@@ -147,13 +214,28 @@ func (fl *freeList) read(head uint64) {
 		}
 		cursor = node.next()
 	}
-	assert(len(freed) == 0, "free list is corrupted")
+	if len(freed) != 0 {
+		corrupted("free list holds %d pages less than its total", len(freed))
+	}
+}
+
+// reset discards the changes made since the last commit, whose free list starts at head, by reading it back.
+// It undoes a write whose commit failed along with the pops and frees made before it.
+func (fl *freeList) reset(head uint64) {
+	fl.head, fl.size = 0, 0
+	fl.freed = fl.freed[:0]
+	clear(fl.cache)
+	fl.pending = fl.pending[:0]
+	fl.popped = fl.popped[:0]
+	fl.popn = 0
+	fl.read(head)
 }
 
 // write does the following
 // remove pages that stored pointers that are in use. As they are removed, these pages are freed.
 // prepend the pages that are pending to be freed to the free list
 func (fl *freeList) write() {
+	fl.version++
 	if fl.popn == 0 && len(fl.pending) == 0 {
 		return
 	}
@@ -164,7 +246,9 @@ func (fl *freeList) write() {
 
 	remaining := []uint64{}
 	for fl.popn > 0 {
-		assert(fl.head != 0, "free list is corrupted")
+		if fl.head == 0 {
+			corrupted("free list ends before its total")
+		}
 		node := fl.pager.load(fl.head).asFreeList()
 		fl.free(fl.head)
 
@@ -185,9 +269,15 @@ func (fl *freeList) write() {
 
 	// nodeRemaining is the number of free pages in the remaining in current node
 	reuse := []uint64{}
-	for fl.freeCount() > 0 && len(reuse)*freeListCap < fl.pendingCount()+len(remaining) {
+	// the remaining and the pending pages are written to separate nodes.
+	nodes := func(n int) int {
+		return (n + freeListCap - 1) / freeListCap
+	}
+	for fl.freeCount() > 0 && !fl.pinned(fl.freed[len(fl.freed)-1]) && len(reuse) < nodes(len(remaining))+nodes(fl.pendingCount()) {
 		if len(remaining) == 0 {
-			assert(fl.head != 0, "free list is corrupted")
+			if fl.head == 0 {
+				corrupted("free list ends before its total")
+			}
 
 			node := fl.pager.load(fl.head).asFreeList()
 			fl.free(fl.head)
@@ -200,6 +290,7 @@ func (fl *freeList) write() {
 		ptr := fl.freed[len(fl.freed)-1]
 		fl.freed = fl.freed[:len(fl.freed)-1]
 		delete(fl.cache, ptr)
+		delete(fl.freedAt, ptr)
 		remaining = remaining[:len(remaining)-1]
 		reuse = append(reuse, ptr)
 
@@ -210,10 +301,20 @@ func (fl *freeList) write() {
 	// prepend the pages that are pending to be freed to the free list
 	reuse = fl.writePtrs(fl.pending, reuse)
 
+	if len(fl.pins) > 0 {
+		for _, ptr := range fl.pending {
+			fl.freedAt[ptr] = fl.version
+		}
+	}
 	fl.freed = append(fl.freed, fl.pending...)
 	fl.pending = fl.pending[:0]
+	fl.popped = fl.popped[:0]
 
-	fl.pager.load(fl.head).asFreeList().setTotal(uint64(fl.size))
+	// the head can be a flushed node, so it is copied rather than modified in place
+	head := newFreeListNode()
+	copy(head.data, fl.pager.load(fl.head).asFreeList().data)
+	head.setTotal(uint64(fl.size))
+	fl.pager.write(Page{ptr: fl.head, inner: head.data})
 }
 
 func (fl *freeList) writePtrs(ptrs []uint64, reuse []uint64) []uint64 {
@@ -235,7 +336,9 @@ func (fl *freeList) writePtrs(ptrs []uint64, reuse []uint64) []uint64 {
 			reuse = reuse[1:]
 			fl.pager.write(Page{ptr: fl.head, inner: new.data})
 		} else {
-			fl.head = fl.pager.allocate(Page{inner: new.data})
+			// the node is appended rather than allocated, as a page popped while the free list is written
+			// would be left in the nodes on disk.
+			fl.head = fl.pager.append(Page{inner: new.data})
 		}
 		fl.size += size
 
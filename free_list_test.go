@@ -1,6 +1,8 @@
 package deadsimpledb
 
 import (
+	"fmt"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -44,6 +46,29 @@ func Test_freeList_pop(t *testing.T) {
 	}
 }
 
+func Test_freeList_pin(t *testing.T) {
+	fl := newFreeList(nil)
+	fl.freed = []uint64{1, 2}
+	fl.size = len(fl.freed)
+	fl.version = 1
+
+	version := fl.pin()
+	require.Equal(t, uint64(1), version)
+	// pages freed by a later commit can be reached by the snapshot
+	fl.freed = append(fl.freed, 3)
+	fl.freedAt[3] = 2
+	fl.version = 2
+
+	_, ok := fl.pop()
+	require.False(t, ok, "Pinned page should not be popped")
+
+	fl.unpin(version)
+	require.Empty(t, fl.freedAt)
+	ptr, ok := fl.pop()
+	require.True(t, ok)
+	require.Equal(t, uint64(3), ptr)
+}
+
 func Test_freeList_free(t *testing.T) {
 	t.Run("Basic free operation", func(t *testing.T) {
 		// Setup
@@ -154,6 +179,29 @@ func Test_freeList_writeRead(t *testing.T) {
 	})
 }
 
+// Test_freeList_writeMany checks that the free list read back matches the one written by a commit freeing
+// more pages than a node holds, whose nodes reuse free pages.
+func Test_freeList_writeMany(t *testing.T) {
+	kv, err := NewKV(filepath.Join(t.TempDir(), "free_list.db"))
+	require.NoError(t, err)
+	defer kv.Close()
+	tx := kv.Begin()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, tx.Set(walKey(i), makeData(fmt.Sprintf("val-%d-", i), 128)))
+	}
+	require.NoError(t, tx.Commit())
+
+	tx = kv.Begin()
+	for i := 100; i < 900; i++ {
+		_, err := tx.Del(walKey(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tx.Commit())
+	fl := newFreeList(kv.pager)
+	fl.read(kv.pager.freeList.head)
+	compareFl(t, kv.pager.freeList, fl)
+}
+
 // / allocateTestPages allocates a specified number of pages
 func allocateTestPages(pager Pager, count int) []uint64 {
 	allocated := make([]uint64, count)
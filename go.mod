@@ -2,11 +2,13 @@ module github/putto11262002/dead_simple_go_db
 
 go 1.23
 
-require github.com/stretchr/testify v1.10.0
+require (
+	github.com/google/btree v1.1.3
+	github.com/stretchr/testify v1.10.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/btree v1.1.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -5,62 +5,261 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"log/slog"
 	"os"
+	"sync"
+	"time"
 )
 
 var (
 	sig = []byte("dead simple db \000")
 )
 
+var (
+	// ErrReadOnly is returned by the mutating calls of a KV or DB opened read-only.
+	ErrReadOnly = errors.New("database is opened read-only")
+	// ErrEmptyKey is returned when a key is empty, the empty key is reserved by the tree.
+	ErrEmptyKey = errors.New("key is empty")
+	// ErrKeyTooLarge is returned when a key is larger than BtreeMaxKeySize.
+	ErrKeyTooLarge = errors.New("key is too large")
+	// ErrValueTooLarge is returned when a value is larger than MaxValueSize.
+	ErrValueTooLarge = errors.New("value is too large")
+	// ErrCorrupt is returned when the data read from the file is not what it is expected to be.
+	// ErrCorruptPage wraps it.
+	ErrCorrupt = errors.New("database is corrupted")
+	// ErrInternal is returned when an internal invariant does not hold, which is a bug rather than a corrupted file.
+	ErrInternal = errors.New("internal error")
+)
+
+// MaxValueSize is the largest value a KV can store. Values are read and written whole, in memory.
+var MaxValueSize = 1 << 30
+
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BtreeMaxKeySize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrKeyTooLarge, len(key), BtreeMaxKeySize)
+	}
+	return nil
+}
+
+func checkValue(val []byte) error {
+	if len(val) > MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrValueTooLarge, len(val), MaxValueSize)
+	}
+	return nil
+}
+
+// Master Page Layout
+// | signature | root | npages | free list head | version | seq | checksum |
+// | 16B       | 8B   | 8B     | 8B             | 4B      | 8B  | 4B       |
+//
+// version is the on-disk format version. Files written before it was introduced read as version 0.
+// Version 1 added the page checksums.
+// Version 2 added the second master page slot.
+// Version 3 added the value tags and the overflow pages, see overflow.go.
+// Version 4 changed the encoding of the table keys, see serializeKey.
+// Version 5 added the null bitmap to the encoding of the table values, see serializeValues.
+// Version 6 added the schema version to the table values, see tableRecord.serializeValues.
+// The KV layout of versions 4 to 6 is the same as version 3, so the KV opens all of them
+// and keeps the version it read until the DB migrates the file, see DB.migrate.
+// Files of versions 0 to 2 are upgraded to the layout of version 3 on open, see KV.upgradeLayout.
+//
+// The master page is double-buffered in pages 0 and 1. Each commit writes the slot that does not hold
+// the current header, seq is incremented on every write and checksum is the CRC32 (Castagnoli) of the bytes before it.
+// On open the valid slot with the highest seq wins, so a torn header write falls back to the previous commit.
+// Versions 0 and 1 have a single master page in page 0, without seq nor checksum, and page 1 holds data.
+const (
+	formatVersion    uint32 = 6
+	minFormatVersion uint32 = 3
+)
+
+const (
+	masterPageSlots = 2
+	masterPageSize  = 16 + 8 + 8 + 8 + 4 + 8
+)
+
 func init() {
 	assert(len(sig) == 16, "invalid signature length")
 }
 
+// KV is safe for concurrent use. Any number of readers run in parallel with a single writer transaction.
+// As the tree is copy-on-write, readers read the tree from the last committed root, which the writer
+// never modifies in place.
 type KV struct {
-	file   *os.File
-	tree   *Btree
-	path   string
-	pager  Pager
-	logger *slog.Logger
+	file *os.File
+	// tree is the tree modified by the writer transaction.
+	tree *Btree
+	// root is the root of the last commit, it is the root readers read from.
+	root  uint64
+	path  string
+	pager *MmapPager
+	// writer is held by the writer transaction from Begin until Commit or Abort.
+	writer sync.Mutex
+	// mu guards root and the pager. Readers hold the read lock while they load pages,
+	// the writer holds the write lock while it allocates, frees or flushes pages.
+	mu sync.RWMutex
+	// wal is the write-ahead log, it is nil unless the KV is opened in WAL mode.
+	wal             *wal
+	checkpointPages int
+	// seq is the sequence number of the current master page.
+	seq uint64
+	// version is the format version written into the master page.
+	version  uint32
+	readOnly bool
+	logger   *slog.Logger
+}
+
+// OpenOptions configures how a KV is opened.
+type OpenOptions struct {
+	// WAL selects the write-ahead log durability mode.
+	// Instead of writing the modified pages into the file and then the master page, each commit appends
+	// the pages to a log next to the file and fsyncs it once. The log is checkpointed into the file
+	// once it holds CheckpointPages pages and when the KV is closed.
+	WAL bool
+	// CheckpointPages is the number of logged pages that triggers a checkpoint.
+	// Zero means defaultCheckpointPages.
+	CheckpointPages int
+	// ReadOnly opens the file without write access. Every mutating call fails with ErrReadOnly and
+	// a log left behind is replayed in memory only. The file is locked with a shared lock instead of an
+	// exclusive one, so any number of read-only opens can share the file but none can while it is opened for writing.
+	ReadOnly bool
+	// LockTimeout is how long to wait for the file lock held by another KV before failing with ErrLocked.
+	// Zero means failing right away.
+	LockTimeout time.Duration
 }
 
 func NewKV(path string) (*KV, error) {
+	return NewKVWithOptions(path, OpenOptions{})
+}
+
+func NewKVWithOptions(path string, opts OpenOptions) (*KV, error) {
 	kv := &KV{
-		path:   path,
-		logger: slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		path:            path,
+		checkpointPages: opts.CheckpointPages,
+		logger:          slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	if kv.checkpointPages <= 0 {
+		kv.checkpointPages = defaultCheckpointPages
 	}
 
 	fail := func(err error) error {
-		if kv.pager != nil {
-			kv.pager.close()
-		}
 		kv.Close()
 		return err
 	}
 
-	f, err := os.OpenFile(kv.path, os.O_RDWR|os.O_CREATE, 0644)
+	flag := os.O_RDWR | os.O_CREATE
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(kv.path, flag, 0644)
 	if err != nil {
 		return nil, fail(fmt.Errorf("os.OpenFile: %w", err))
 	}
 	kv.file = f
+	if err := lockFile(f, !opts.ReadOnly, opts.LockTimeout); err != nil {
+		return nil, fail(fmt.Errorf("locking file: %w", err))
+	}
 	header, err := kv.loadMasterPage()
 	if err != nil {
 		return nil, fail(fmt.Errorf("reading header: %w", err))
 	}
+	legacy := header
+	if kv.version < minFormatVersion {
+		if opts.ReadOnly {
+			return nil, fail(fmt.Errorf("format version %d must be upgraded to %d, open the file for writing once: %w", kv.version, minFormatVersion, ErrReadOnly))
+		}
+		if stat, err := os.Stat(walPath(path)); err == nil && stat.Size() != 0 {
+			return nil, fail(fmt.Errorf("the log of format version %d cannot be replayed, open the file with the version that wrote it to checkpoint it", kv.version))
+		}
+		// the pages of the old layout are only read by upgradeLayout, the pager starts with no tree and no free list.
+		header = Header{flushed: max(legacy.flushed, pagerPageOffset)}
+	}
 
-	kv.pager, err = newMmapPagerWithFreeList(kv.file, header.flushed, header.freeList)
+	// A log left behind by a KV opened in WAL mode is replayed even when
+	// opening without it, otherwise its commits would be lost.
+	var logged map[uint64]Page
+	if _, err := os.Stat(walPath(path)); (opts.WAL && !opts.ReadOnly) || err == nil {
+		kv.wal, err = openWal(walPath(path), opts.ReadOnly)
+		if err != nil {
+			return nil, fail(fmt.Errorf("opening log: %w", err))
+		}
+		logged = make(map[uint64]Page)
+		err = kv.wal.replay(func(h Header, pages []Page) {
+			for _, page := range pages {
+				logged[page.ptr] = page
+			}
+			header = h
+		})
+		if err != nil {
+			return nil, fail(fmt.Errorf("replaying log: %w", err))
+		}
+	}
+
+	pager, err := newMmapPagerWithFreeList(kv.file, header.flushed, header.freeList, logged, opts.ReadOnly)
 	if err != nil {
 		return nil, fail(fmt.Errorf("initializing pager: %w", err))
 	}
+	kv.pager = pager
 
 	kv.tree = newBtree(header.root, kv.pager)
+	kv.root = header.root
+	kv.readOnly = opts.ReadOnly
+
+	if kv.readOnly {
+		// the replayed pages are served by the pager, the log is left for the next writer to checkpoint.
+		if kv.wal != nil {
+			if err := kv.wal.close(); err != nil {
+				return nil, fail(fmt.Errorf("closing log: %w", err))
+			}
+			kv.wal = nil
+		}
+		return kv, nil
+	}
+
+	if kv.wal != nil {
+		if err := kv.checkpoint(); err != nil {
+			return nil, fail(fmt.Errorf("checkpointing log: %w", err))
+		}
+	}
+	if kv.wal != nil && !opts.WAL {
+		if err := kv.wal.close(); err != nil {
+			return nil, fail(fmt.Errorf("closing log: %w", err))
+		}
+		kv.wal = nil
+		if err := os.Remove(walPath(path)); err != nil {
+			return nil, fail(fmt.Errorf("removing log: %w", err))
+		}
+	}
+	if kv.version < minFormatVersion {
+		if err := kv.upgradeLayout(legacy); err != nil {
+			return nil, fail(fmt.Errorf("upgrading format version %d: %w", kv.version, err))
+		}
+	}
 
 	return kv, nil
 
 }
 
+// Close checkpoints the log, if any, and closes the file.
+// It waits for the active writer transaction, if any, to finish.
 func (db *KV) Close() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.wal != nil {
+		if db.pager != nil {
+			if err := db.checkpoint(); err != nil {
+				db.logger.Error(fmt.Sprintf("checkpointing log: %v", err))
+			}
+		}
+		if err := db.wal.close(); err != nil {
+			db.logger.Error(fmt.Sprintf("closing log: %v", err))
+		}
+	}
 	if db.pager != nil {
 		if err := db.pager.close(); err != nil {
 			db.logger.Error(fmt.Sprintf("closing pager: %v", err))
@@ -72,36 +271,60 @@ func (db *KV) Close() error {
 	return nil
 }
 
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+// Get reads the value of the key as of the last commit.
+func (db *KV) Get(key []byte) (val []byte, ok bool, err error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer recoverPanic(&err)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored, ok := newBtree(db.root, db.pager).Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	// the value is copied as it points into a page which can be reused once the lock is released.
+	return decodeValue(db.pager, stored), true, nil
 }
 
 func (db *KV) Set(key, value []byte) error {
-	db.tree.Insert(key, value)
-	return db.flush()
+	tx := db.Begin()
+	if err := tx.Set(key, value); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit()
 }
 
 func (kv *KV) Update(key []byte, val []byte, mode InsertMode) (bool, error) {
-	res := kv.tree.InsertEx(key, val, mode)
-	var ok bool
-	if mode == Insert {
-		ok = res.Inserted
-	}
-	if mode == Update {
-		ok = res.Updated
-	}
-	if mode == Upsert {
-		ok = res.Inserted || res.Updated
+	tx := kv.Begin()
+	ok, err := tx.Update(key, val, mode)
+	if err != nil {
+		tx.Abort()
+		return false, err
 	}
-	return ok, kv.flush()
+	return ok, tx.Commit()
 }
 
 func (db *KV) Del(key []byte) (bool, error) {
-	ok := db.tree.Delete(key)
-	if !ok {
-		return false, nil
+	tx := db.Begin()
+	ok, err := tx.Del(key)
+	if err != nil || !ok {
+		tx.Abort()
+		return false, err
 	}
-	return ok, db.flush()
+	return ok, tx.Commit()
+}
+
+// DeleteRange deletes the keys from start, included, to end, excluded, in a single commit, see KVTx.DeleteRange.
+func (kv *KV) DeleteRange(start, end []byte) (int, error) {
+	tx := kv.Begin()
+	n, err := tx.DeleteRange(start, end)
+	if err != nil || n == 0 {
+		tx.Abort()
+		return 0, err
+	}
+	return n, tx.Commit()
 }
 
 type Header struct {
@@ -111,11 +334,12 @@ type Header struct {
 }
 
 var defaultHeader Header = Header{
-	flushed:  1,
+	flushed:  pagerPageOffset,
 	root:     0,
 	freeList: 0,
 }
 
+// loadMasterPage reads both master page slots and returns the header of the newest valid one.
 func (db *KV) loadMasterPage() (Header, error) {
 	stat, err := db.file.Stat()
 	if err != nil {
@@ -124,55 +348,142 @@ func (db *KV) loadMasterPage() (Header, error) {
 	fileSize := int(stat.Size())
 	if fileSize == 0 {
 		// if it is an empty file no-op
+		db.version = formatVersion
 		return defaultHeader, nil
 	}
 
+	var (
+		newest   masterPage
+		found    bool
+		firstErr error
+	)
+	for slot := 0; slot < masterPageSlots; slot++ {
+		mp, err := db.readMasterPage(slot, fileSize)
+		if errors.Is(err, errMasterPageNotWritten) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("slot %d: %w", slot, err)
+			}
+			continue
+		}
+		if !found || mp.seq > newest.seq {
+			newest, found = mp, true
+		}
+	}
+	if !found {
+		if firstErr == nil {
+			firstErr = errMasterPageNotWritten
+		}
+		return defaultHeader, firstErr
+	}
+	db.seq = newest.seq
+	db.version = newest.version
+	return newest.header, nil
+}
+
+// masterPage is the content of a master page slot.
+type masterPage struct {
+	header  Header
+	seq     uint64
+	version uint32
+}
+
+// errMasterPageNotWritten is returned for a slot that has never been written,
+// both slots are only written from the second commit on.
+var errMasterPageNotWritten = errors.New("master page not written")
+
+func (db *KV) readMasterPage(slot int, fileSize int) (masterPage, error) {
+	if fileSize < (slot+1)*PageSize {
+		return masterPage{}, errMasterPageNotWritten
+	}
 	page := make([]byte, PageSize)
-	n, err := db.file.ReadAt(page, 0)
+	n, err := db.file.ReadAt(page, int64(slot*PageSize))
 	if err != nil {
-		return defaultHeader, err
+		return masterPage{}, err
 	}
 	assert(n == PageSize, "invalid master page size")
+	if bytes.Equal(page, make([]byte, PageSize)) {
+		return masterPage{}, errMasterPageNotWritten
+	}
 
 	_sig := page[0:16]
 	root := binary.LittleEndian.Uint64(page[16:])
 	npages := binary.LittleEndian.Uint64(page[24:])
 	freeListHead := binary.LittleEndian.Uint64(page[32:])
+	version := binary.LittleEndian.Uint32(page[40:])
+	seq := binary.LittleEndian.Uint64(page[44:])
+	checksum := binary.LittleEndian.Uint32(page[masterPageSize:])
 
 	if !bytes.Equal(sig, _sig[:len(sig)]) {
-		return defaultHeader, errors.New("invalid signature")
+		return masterPage{}, errors.New("invalid signature")
+	}
+
+	if version > formatVersion {
+		return masterPage{}, fmt.Errorf("unsupported format version %d, expected up to %d", version, formatVersion)
+	}
+
+	offset := uint64(pagerPageOffset)
+	if version < 2 {
+		// the single master page of versions 0 and 1 has no checksum, and it has no seq so any header written since wins.
+		if slot != 0 {
+			return masterPage{}, fmt.Errorf("format version %d in slot %d", version, slot)
+		}
+		offset, seq = 1, 0
+	} else if crc32.Checksum(page[:masterPageSize], castagnoli) != checksum {
+		return masterPage{}, errors.New("checksum mismatch")
 	}
 
 	if freeListHead < 0 || freeListHead >= npages {
-		return defaultHeader, errors.New("invalid free list head")
+		return masterPage{}, errors.New("invalid free list head")
 	}
 
-	bad := (npages < 1) || (npages > uint64(fileSize/PageSize)) || (root < 0) || (root >= npages)
+	bad := (npages < offset) || (npages > uint64(fileSize/PageSize)) || (root < 0) || (root >= npages)
 	if bad {
-		return defaultHeader, errors.New("invalid master page")
+		return masterPage{}, errors.New("invalid master page")
 	}
-	return Header{
-		root:     root,
-		freeList: freeListHead,
-		flushed:  npages,
+	return masterPage{
+		header: Header{
+			root:     root,
+			freeList: freeListHead,
+			flushed:  npages,
+		},
+		seq:     seq,
+		version: version,
 	}, nil
 }
 
+// writeMasterPage writes the header into the slot not holding the current one.
+// The current header is left intact until the write is synced.
 func (db *KV) writeMasterPage(header Header) error {
+	seq := db.seq + 1
 	data := make([]byte, PageSize)
 	copy(data[0:], sig)
 	binary.LittleEndian.PutUint64(data[16:], header.root)
 	binary.LittleEndian.PutUint64(data[24:], header.flushed)
 	binary.LittleEndian.PutUint64(data[32:], header.freeList)
+	binary.LittleEndian.PutUint32(data[40:], db.version)
+	binary.LittleEndian.PutUint64(data[44:], seq)
+	binary.LittleEndian.PutUint32(data[masterPageSize:], crc32.Checksum(data[:masterPageSize], castagnoli))
 
-	_, err := db.file.WriteAt(data, 0)
+	_, err := db.file.WriteAt(data, int64(seq%masterPageSlots)*int64(PageSize))
 	if err != nil {
 		return err
 	}
+	db.seq = seq
 	return nil
 }
 
 func (db *KV) flush() error {
+	if db.wal != nil {
+		return db.flushLog()
+	}
+	return db.flushFile()
+}
+
+// flushFile commits by writing the pages into the file followed by the master page.
+func (db *KV) flushFile() error {
 	pagerMetadata, err := db.pager.flush()
 	if err != nil {
 		return fmt.Errorf("flushing pager: %w", err)
@@ -193,3 +504,72 @@ func (db *KV) flush() error {
 
 	return nil
 }
+
+// flushVersion commits like flush and changes the format version.
+// The log records do not carry the version, so the commit is written into the file even in WAL mode,
+// which requires the log to be empty.
+func (kv *KV) flushVersion(version uint32) error {
+	if kv.wal != nil && kv.wal.size != 0 {
+		return errors.New("changing the format version with a non-empty log")
+	}
+	prev := kv.version
+	kv.version = version
+	if err := kv.flushFile(); err != nil {
+		kv.version = prev
+		return err
+	}
+	return nil
+}
+
+// flushLog commits by appending to the log, which is checkpointed once it grows past checkpointPages.
+func (kv *KV) flushLog() error {
+	if _, err := kv.pager.flushLog(kv.wal, kv.tree.root); err != nil {
+		return fmt.Errorf("flushing pager to log: %w", err)
+	}
+	if kv.wal.npages >= kv.checkpointPages {
+		// the commit is durable once it is in the log, a failed checkpoint is retried by the next commit.
+		if err := kv.checkpoint(); err != nil {
+			kv.logger.Error(fmt.Sprintf("checkpointing log: %v", err))
+		}
+	}
+	return nil
+}
+
+// Checkpoint folds the log into the file. It is a no-op unless the KV is opened in WAL mode,
+// and it fails with ErrReadOnly if the KV is opened read-only.
+func (kv *KV) Checkpoint() error {
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	if kv.wal == nil {
+		return nil
+	}
+	kv.writer.Lock()
+	defer kv.writer.Unlock()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.checkpoint()
+}
+
+// checkpoint writes the logged pages into the file, followed by the master page of the last commit, and then discards the log.
+// A crash before the log is discarded replays the same pages again on the next open.
+// It must not be called while a transaction is in progress as the tree root would not be committed.
+func (kv *KV) checkpoint() error {
+	if kv.wal.size == 0 {
+		return nil
+	}
+	if err := kv.pager.checkpoint(); err != nil {
+		return err
+	}
+	if err := kv.writeMasterPage(Header{
+		root:     kv.tree.root,
+		flushed:  kv.pager.flushed,
+		freeList: kv.pager.freeList.head,
+	}); err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+	if err := kv.file.Sync(); err != nil {
+		return fmt.Errorf("fsync master page: %w", err)
+	}
+	return kv.wal.reset()
+}
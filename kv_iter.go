@@ -0,0 +1,231 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"iter"
+)
+
+// All returns every key of the KV with its value, in key order, see Range.
+// It panics if it fails to read the KV, Iterator reports the errors instead.
+func (kv *KV) All() iter.Seq2[[]byte, []byte] {
+	return kv.Range(nil, nil)
+}
+
+// Range returns the keys from start, included, to end, excluded, with their values in key order.
+// A nil end ranges to the last key.
+//
+// The iteration reads a snapshot taken when it starts, which is released when it ends, including
+// when the loop is broken out of. The lock of the KV is not held while the loop body runs, so the body
+// can write to the KV, which does not change what the iteration reads. The keys and values are copies.
+//
+// As the iteration can not return an error, it panics if it fails to read the KV, for instance on a corrupted page.
+// Iterator and ScanPrefix report the errors through Err instead.
+func (kv *KV) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	return kv.iterate(start, func(key []byte) bool {
+		return end == nil || bytes.Compare(key, end) < 0
+	})
+}
+
+// Prefix returns the keys starting with the prefix with their values in key order, see Range.
+// It panics if it fails to read the KV, ScanPrefix reports the errors instead.
+func (kv *KV) Prefix(prefix []byte) iter.Seq2[[]byte, []byte] {
+	return kv.iterate(prefix, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+// iterate returns the keys from start as long as they are within the range.
+func (kv *KV) iterate(start []byte, within func(key []byte) bool) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		snap := kv.Snapshot()
+		defer snap.Close()
+		iter, err := snap.Seek(truncateSeek(start, CmpGE))
+		if err != nil {
+			panic(err)
+		}
+		for {
+			key, val, ok, err := snap.next(iter)
+			if err != nil {
+				panic(err)
+			}
+			if !ok || !within(key) || !yield(key, val) {
+				return
+			}
+		}
+	}
+}
+
+// next returns a copy of the key and the value the iterator points to and moves it to the next key.
+func (snap *KVSnapshot) next(iter *BtreeIter) (key, val []byte, ok bool, err error) {
+	defer recoverPanic(&err)
+	snap.kv.mu.RLock()
+	defer snap.kv.mu.RUnlock()
+	k, stored, ok := iter.Cur()
+	if !ok {
+		return nil, nil, false, nil
+	}
+	key, val = bytes.Clone(k), decodeValue(snap.kv.pager, stored)
+	iter.next()
+	return key, val, true, nil
+}
+
+// Iterator is a bidirectional cursor over the keys of a KV, it reads a snapshot taken when it is created.
+// It starts invalid, First, Last or Seek positions it. Once it moves past either end it becomes invalid
+// until it is positioned again.
+//
+// It must be closed once done with to release its snapshot, and must not be used by more than one goroutine at a time.
+type Iterator struct {
+	snap *KVSnapshot
+	iter *BtreeIter
+	// prefix is the prefix of the keys the iterator is confined to, see KV.ScanPrefix.
+	prefix []byte
+	key    []byte
+	// val is the value of the current key, it is read on the first call to Value.
+	val []byte
+	err error
+}
+
+// Iterator returns an iterator over a snapshot of the last commit.
+func (kv *KV) Iterator() *Iterator {
+	return &Iterator{snap: kv.Snapshot()}
+}
+
+// ScanPrefix returns an iterator over the keys starting with the prefix, see Iterator.
+// It moves over the same keys as Prefix, but reports the errors through Err instead of panicking.
+func (kv *KV) ScanPrefix(prefix []byte) *Iterator {
+	return &Iterator{snap: kv.Snapshot(), prefix: bytes.Clone(prefix)}
+}
+
+// First moves to the first key, it returns false if the KV is empty.
+func (it *Iterator) First() bool {
+	return it.Seek(it.prefix, CmpGE)
+}
+
+// Last moves to the last key, it returns false if the KV is empty.
+func (it *Iterator) Last() bool {
+	if succ := prefixSuccessor(it.prefix); succ != nil {
+		return it.Seek(succ, CmpLT)
+	}
+	// no key is greater than the largest key of the maximum size.
+	return it.Seek(bytes.Repeat([]byte{0xff}, BtreeMaxKeySize), CmpLE)
+}
+
+// Seek moves to the first key satisfying the comparison with the given key: the smallest key for CmpGE and CmpGT,
+// the largest one for CmpLE and CmpLT. It returns false if there is none, or if the key does not start with the prefix
+// of the iterator.
+func (it *Iterator) Seek(key []byte, cmp Cmp) bool {
+	it.iter, it.err = it.snap.Seek(truncateSeek(key, cmp))
+	return it.load()
+}
+
+// truncateSeek returns a seek satisfied by the same keys as the seek of key with cmp,
+// whose key is within the maximum key size. No key is longer, so the keys greater than a longer key are the ones
+// greater than its truncation, and the keys less than it are the ones less than or equal to its truncation.
+func truncateSeek(key []byte, cmp Cmp) ([]byte, Cmp) {
+	if len(key) <= BtreeMaxKeySize {
+		return key, cmp
+	}
+	if cmp > 0 {
+		return key[:BtreeMaxKeySize], CmpGT
+	}
+	return key[:BtreeMaxKeySize], CmpLE
+}
+
+// Next moves to the next key, it returns false if there is none.
+func (it *Iterator) Next() bool {
+	return it.move(func(iter *BtreeIter) { iter.next() })
+}
+
+// Prev moves to the previous key, it returns false if there is none.
+func (it *Iterator) Prev() bool {
+	return it.move(func(iter *BtreeIter) { iter.prev() })
+}
+
+func (it *Iterator) move(step func(iter *BtreeIter)) bool {
+	if !it.Valid() {
+		return false
+	}
+	func() {
+		defer recoverPanic(&it.err)
+		it.snap.kv.mu.RLock()
+		defer it.snap.kv.mu.RUnlock()
+		step(it.iter)
+	}()
+	return it.load()
+}
+
+// load reads the key the iterator points to.
+func (it *Iterator) load() bool {
+	it.key, it.val = nil, nil
+	if it.err != nil {
+		return false
+	}
+	defer recoverPanic(&it.err)
+	it.snap.kv.mu.RLock()
+	defer it.snap.kv.mu.RUnlock()
+	if key, _, ok := it.iter.Cur(); ok && bytes.HasPrefix(key, it.prefix) {
+		it.key = bytes.Clone(key)
+	}
+	return it.key != nil
+}
+
+// Valid returns true if the iterator points to a key.
+func (it *Iterator) Valid() bool {
+	return it.key != nil && it.err == nil
+}
+
+// Key returns the current key, nil if the iterator is invalid. It is a copy.
+func (it *Iterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	return it.key
+}
+
+// Value returns the value of the current key, nil if the iterator is invalid. It is a copy.
+// If it fails to read the value it returns nil and the iterator becomes invalid, see Err.
+func (it *Iterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	if it.val == nil {
+		func() {
+			defer recoverPanic(&it.err)
+			it.snap.kv.mu.RLock()
+			defer it.snap.kv.mu.RUnlock()
+			_, stored, _ := it.iter.Cur()
+			it.val = decodeValue(it.snap.kv.pager, stored)
+		}()
+	}
+	if it.err != nil {
+		return nil
+	}
+	return it.val
+}
+
+// Err returns the error that made the iterator invalid, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot of the iterator. Closing an iterator that is already closed is a no-op.
+func (it *Iterator) Close() {
+	it.snap.Close()
+	it.key, it.val = nil, nil
+	if it.err == nil {
+		it.err = ErrSnapshotClosed
+	}
+}
+
+// prefixSuccessor returns the smallest key greater than every key starting with the prefix,
+// nil if there is none as the prefix only holds 0xff.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			succ := bytes.Clone(prefix[:i+1])
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVIter(t *testing.T) {
+	kv, err := NewKV(filepath.Join(t.TempDir(), "iter.db"))
+	require.NoError(t, err)
+	defer kv.Close()
+	key := func(prefix string, i int) []byte {
+		return []byte(fmt.Sprintf("%s%03d", prefix, i))
+	}
+	tx := kv.Begin()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, tx.Set(key("a", i), key("val-a", i)))
+		require.NoError(t, tx.Set(key("b", i), bytes.Repeat(key("val-b", i), PageSize)))
+	}
+	require.NoError(t, tx.Commit())
+
+	collect := func(seq func(func([]byte, []byte) bool)) (keys, vals [][]byte) {
+		for k, v := range seq {
+			keys = append(keys, k)
+			vals = append(vals, v)
+		}
+		return keys, vals
+	}
+
+	t.Run("all", func(t *testing.T) {
+		keys, vals := collect(kv.All())
+		require.Len(t, keys, 100)
+		require.Equal(t, key("a", 0), keys[0])
+		require.Equal(t, key("b", 49), keys[99])
+		require.Equal(t, bytes.Repeat(key("val-b", 49), PageSize), vals[99])
+	})
+
+	t.Run("range", func(t *testing.T) {
+		keys, vals := collect(kv.Range(key("a", 10), key("a", 13)))
+		require.Equal(t, [][]byte{key("a", 10), key("a", 11), key("a", 12)}, keys)
+		require.Equal(t, [][]byte{key("val-a", 10), key("val-a", 11), key("val-a", 12)}, vals)
+
+		keys, _ = collect(kv.Range(key("b", 48), nil))
+		require.Equal(t, [][]byte{key("b", 48), key("b", 49)}, keys)
+		keys, _ = collect(kv.Range(key("c", 0), nil))
+		require.Empty(t, keys)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		keys, _ := collect(kv.Prefix([]byte("b01")))
+		require.Len(t, keys, 10)
+		require.Equal(t, key("b", 10), keys[0])
+		require.Equal(t, key("b", 19), keys[9])
+	})
+
+	t.Run("start_too_large", func(t *testing.T) {
+		large := append(key("a", 10), bytes.Repeat([]byte{0}, BtreeMaxKeySize)...)
+		keys, _ := collect(kv.Range(large, key("a", 13)))
+		require.Equal(t, [][]byte{key("a", 11), key("a", 12)}, keys)
+		keys, _ = collect(kv.Prefix(large))
+		require.Empty(t, keys)
+	})
+
+	t.Run("break_and_write", func(t *testing.T) {
+		n := 0
+		for k := range kv.Prefix([]byte("a")) {
+			// the loop body writes to the KV, the iteration keeps reading its snapshot.
+			_, err := kv.Del(k)
+			require.NoError(t, err)
+			if n++; n == 5 {
+				break
+			}
+		}
+		require.Empty(t, kv.pager.freeList.pins)
+		keys, _ := collect(kv.Prefix([]byte("a")))
+		require.Len(t, keys, 45)
+	})
+}
+
+func TestKVIterEmpty(t *testing.T) {
+	kv, err := NewKV(filepath.Join(t.TempDir(), "empty.db"))
+	require.NoError(t, err)
+	defer kv.Close()
+	requireEmpty := func(t *testing.T) {
+		for range kv.All() {
+			t.Fatal("unexpected key")
+		}
+		for range kv.Range([]byte("a"), []byte("z")) {
+			t.Fatal("unexpected key")
+		}
+		for range kv.Prefix([]byte("a")) {
+			t.Fatal("unexpected key")
+		}
+	}
+
+	t.Run("fresh", requireEmpty)
+
+	t.Run("emptied", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, kv.Set([]byte(fmt.Sprintf("a%03d", i)), []byte("val")))
+		}
+		for i := 0; i < 100; i++ {
+			ok, err := kv.Del([]byte(fmt.Sprintf("a%03d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		require.Zero(t, kv.tree.root)
+		requireEmpty(t)
+	})
+}
+
+func TestKVIterator(t *testing.T) {
+	kv, err := NewKV(filepath.Join(t.TempDir(), "iterator.db"))
+	require.NoError(t, err)
+	defer kv.Close()
+
+	t.Run("empty", func(t *testing.T) {
+		it := kv.Iterator()
+		defer it.Close()
+		require.False(t, it.Valid())
+		require.False(t, it.First())
+		require.False(t, it.Last())
+		require.False(t, it.Seek(walKey(1), CmpLE))
+		require.Nil(t, it.Key())
+		require.NoError(t, it.Err())
+	})
+
+	tx := kv.Begin()
+	for i := 0; i < 1000; i += 2 {
+		require.NoError(t, tx.Set(walKey(i), []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, tx.Commit())
+
+	t.Run("forward_and_backward", func(t *testing.T) {
+		it := kv.Iterator()
+		defer it.Close()
+		n := 0
+		for ok := it.First(); ok; ok = it.Next() {
+			require.Equal(t, walKey(n), it.Key())
+			require.Equal(t, []byte(fmt.Sprint(n)), it.Value())
+			n += 2
+		}
+		require.Equal(t, 1000, n)
+		require.False(t, it.Valid())
+
+		for ok := it.Last(); ok; ok = it.Prev() {
+			n -= 2
+			require.Equal(t, walKey(n), it.Key())
+		}
+		require.Equal(t, 0, n)
+		require.NoError(t, it.Err())
+	})
+
+	t.Run("seek", func(t *testing.T) {
+		it := kv.Iterator()
+		defer it.Close()
+		for _, tc := range []struct {
+			key      []byte
+			cmp      Cmp
+			expected []byte
+		}{
+			{walKey(10), CmpGE, walKey(10)},
+			{walKey(10), CmpGT, walKey(12)},
+			{walKey(11), CmpGE, walKey(12)},
+			{walKey(10), CmpLE, walKey(10)},
+			{walKey(10), CmpLT, walKey(8)},
+			{walKey(11), CmpLE, walKey(10)},
+			{walKey(998), CmpGT, nil},
+			{walKey(0), CmpLT, nil},
+			// a key longer than the maximum key size is truncated, like the start of Range.
+			{append(walKey(10), make([]byte, BtreeMaxKeySize)...), CmpGE, walKey(12)},
+			{append(walKey(10), make([]byte, BtreeMaxKeySize)...), CmpGT, walKey(12)},
+			{append(walKey(10), make([]byte, BtreeMaxKeySize)...), CmpLE, walKey(10)},
+			{append(walKey(10), make([]byte, BtreeMaxKeySize)...), CmpLT, walKey(10)},
+		} {
+			require.Equal(t, tc.expected != nil, it.Seek(tc.key, tc.cmp))
+			require.Equal(t, tc.expected, it.Key())
+		}
+		require.NoError(t, it.Err())
+		require.True(t, it.Seek(walKey(500), CmpGE))
+		require.True(t, it.Prev())
+		require.Equal(t, walKey(498), it.Key())
+		require.True(t, it.Next())
+		require.True(t, it.Next())
+		require.Equal(t, walKey(502), it.Key())
+	})
+
+	t.Run("scan_prefix", func(t *testing.T) {
+		it := kv.ScanPrefix([]byte("key-01"))
+		defer it.Close()
+		var keys [][]byte
+		for ok := it.First(); ok; ok = it.Next() {
+			keys = append(keys, it.Key())
+		}
+		require.Len(t, keys, 50)
+		require.Equal(t, walKey(100), keys[0])
+		require.Equal(t, walKey(198), keys[49])
+		require.True(t, it.Last())
+		require.Equal(t, walKey(198), it.Key())
+		require.True(t, it.Seek(walKey(151), CmpGE))
+		require.Equal(t, walKey(152), it.Key())
+		require.False(t, it.Seek(walKey(198), CmpGT))
+		require.False(t, it.Seek(walKey(0), CmpGE))
+		require.NoError(t, it.Err())
+
+		empty := kv.ScanPrefix([]byte("missing"))
+		defer empty.Close()
+		require.False(t, empty.First())
+		require.False(t, empty.Last())
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		it := kv.Iterator()
+		require.True(t, it.First())
+		// the iterator keeps reading the commit it is created at.
+		require.NoError(t, kv.Set(walKey(2), []byte("overwritten")))
+		require.True(t, it.Next())
+		require.Equal(t, walKey(2), it.Key())
+		require.Equal(t, []byte("2"), it.Value())
+		it.Close()
+		require.False(t, it.Valid())
+		require.False(t, it.First())
+		require.ErrorIs(t, it.Err(), ErrSnapshotClosed)
+		require.Empty(t, kv.pager.freeList.pins)
+	})
+
+	t.Run("emptied", func(t *testing.T) {
+		_, err := kv.DeleteRange(nil, nil)
+		require.NoError(t, err)
+		require.Zero(t, kv.tree.root)
+
+		it := kv.Iterator()
+		defer it.Close()
+		require.False(t, it.First())
+		require.False(t, it.Last())
+		for _, cmp := range []Cmp{CmpGE, CmpGT, CmpLT, CmpLE} {
+			require.False(t, it.Seek(walKey(10), cmp))
+		}
+		require.NoError(t, it.Err())
+	})
+}
@@ -0,0 +1,77 @@
+package deadsimpledb
+
+import (
+	"errors"
+)
+
+var ErrSnapshotClosed = errors.New("snapshot has already been closed")
+
+// KVSnapshot is a read-only view of a KV as of the commit it was taken at.
+// The pages reachable from its root are not reused by later commits until it is closed,
+// so it reads the same data no matter the writes made in the meantime.
+//
+// It can be read by multiple goroutines, but it must only be closed once all the reads are done.
+// A snapshot that is never closed keeps the KV from reusing any page freed after it was taken.
+type KVSnapshot struct {
+	kv      *KV
+	tree    *Btree
+	version uint64
+	closed  bool
+}
+
+// Snapshot takes a snapshot of the last commit.
+func (kv *KV) Snapshot() *KVSnapshot {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return &KVSnapshot{
+		kv:      kv,
+		tree:    newBtree(kv.root, kv.pager),
+		version: kv.pager.freeList.pin(),
+	}
+}
+
+func (snap *KVSnapshot) Get(key []byte) (val []byte, ok bool, err error) {
+	if snap.closed {
+		return nil, false, ErrSnapshotClosed
+	}
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer recoverPanic(&err)
+	snap.kv.mu.RLock()
+	defer snap.kv.mu.RUnlock()
+	stored, ok := snap.tree.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	// the value is copied as it points into a page which can be reused once the snapshot is closed.
+	return decodeValue(snap.kv.pager, stored), true, nil
+}
+
+// Seek creates an iterator that starts at a key satisfying the given comparison.
+// The iterator yields the values as they are stored in the tree, see decodeValue.
+// The iterator must be used while holding the read lock of the KV, see Scanner,
+// and it is invalidated by Close.
+func (snap *KVSnapshot) Seek(key []byte, cmp Cmp) (iter *BtreeIter, err error) {
+	if snap.closed {
+		return nil, ErrSnapshotClosed
+	}
+	if len(key) > BtreeMaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	defer recoverPanic(&err)
+	snap.kv.mu.RLock()
+	defer snap.kv.mu.RUnlock()
+	return snap.tree.Seek(key, cmp), nil
+}
+
+// Close releases the pages of the snapshot. Closing a snapshot that is already closed is a no-op.
+func (snap *KVSnapshot) Close() {
+	if snap.closed {
+		return
+	}
+	snap.closed = true
+	snap.kv.mu.Lock()
+	defer snap.kv.mu.Unlock()
+	snap.kv.pager.freeList.unpin(snap.version)
+}
@@ -0,0 +1,78 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVSnapshot(t *testing.T) {
+	setupKV := func(t *testing.T) *KV {
+		kv, err := NewKV(filepath.Join(t.TempDir(), "snapshot.db"))
+		require.NoError(t, err)
+		return kv
+	}
+	val := func(i, round int) []byte {
+		return makeData(fmt.Sprintf("val-%d-%d-", i, round), 256)
+	}
+	set := func(t *testing.T, kv *KV, round int) {
+		tx := kv.Begin()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, tx.Set(walKey(i), val(i, round)))
+		}
+		require.NoError(t, tx.Commit())
+	}
+
+	t.Run("consistent_reads", func(t *testing.T) {
+		kv := setupKV(t)
+		defer kv.Close()
+		set(t, kv, 0)
+
+		snap := kv.Snapshot()
+		// every commit frees the pages of the previous tree, which would be reused by the next one
+		for round := 1; round < 5; round++ {
+			set(t, kv, round)
+		}
+		for i := 0; i < 100; i += 2 {
+			_, err := kv.Del(walKey(i))
+			require.NoError(t, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			got, ok, err := snap.Get(walKey(i))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, val(i, 0), got)
+		}
+		_, ok, err := kv.Get(walKey(0))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		snap.Close()
+		_, _, err = snap.Get(walKey(1))
+		require.ErrorIs(t, err, ErrSnapshotClosed)
+		snap.Close()
+	})
+
+	t.Run("release", func(t *testing.T) {
+		kv := setupKV(t)
+		defer kv.Close()
+		set(t, kv, 0)
+
+		snap := kv.Snapshot()
+		set(t, kv, 1)
+		flushed := kv.pager.flushed
+		set(t, kv, 2)
+		// the pages freed since the snapshot cannot be reused so the file grows
+		require.Greater(t, kv.pager.flushed, flushed)
+
+		snap.Close()
+		require.Empty(t, kv.pager.freeList.pins)
+		set(t, kv, 3)
+		flushed = kv.pager.flushed
+		set(t, kv, 4)
+		require.Equal(t, flushed, kv.pager.flushed)
+	})
+}
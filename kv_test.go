@@ -61,7 +61,8 @@ func TestKV(t *testing.T) {
 				require.NoError(t, err)
 
 				// Verify it was set correctly
-				retrievedValue, exists := db.Get(key)
+				retrievedValue, exists, err := db.Get(key)
+				require.NoError(t, err)
 				testAssert.True(t, exists)
 				testAssert.True(t, bytes.Equal(value, retrievedValue))
 			})
@@ -87,7 +88,8 @@ func TestKV(t *testing.T) {
 
 			// Then verify all were set correctly
 			for i := 0; i < numPairs; i++ {
-				retrievedValue, exists := db.Get(keys[i])
+				retrievedValue, exists, err := db.Get(keys[i])
+				require.NoError(t, err)
 				testAssert.True(t, exists)
 				testAssert.True(t, bytes.Equal(values[i], retrievedValue))
 			}
@@ -111,7 +113,8 @@ func TestKV(t *testing.T) {
 				key := makeData(fmt.Sprintf("key-%s-", tc.name), tc.keySize)
 				expectedValue := makeData(fmt.Sprintf("value-%s-", tc.name), tc.valueSize)
 
-				value, exists := db.Get(key)
+				value, exists, err := db.Get(key)
+				require.NoError(t, err)
 				testAssert.True(t, exists)
 				testAssert.True(t, bytes.Equal(expectedValue, value))
 			})
@@ -120,7 +123,8 @@ func TestKV(t *testing.T) {
 		// Test getting a non-existent key
 		t.Run("NonExistentKey", func(t *testing.T) {
 			nonExistentKey := []byte("this-key-does-not-exist")
-			value, exists := db.Get(nonExistentKey)
+			value, exists, err := db.Get(nonExistentKey)
+			require.NoError(t, err)
 			testAssert.False(t, exists)
 			testAssert.Nil(t, value)
 		})
@@ -145,7 +149,8 @@ func TestKV(t *testing.T) {
 					testAssert.True(t, ok)
 
 					// Verify the value was inserted
-					retrievedValue, exists := db.Get(key)
+					retrievedValue, exists, err := db.Get(key)
+					require.NoError(t, err)
 					testAssert.True(t, exists)
 					testAssert.True(t, bytes.Equal(initialValue, retrievedValue))
 
@@ -155,7 +160,8 @@ func TestKV(t *testing.T) {
 					testAssert.False(t, ok)
 
 					// Value should remain unchanged
-					retrievedValue, exists = db.Get(key)
+					retrievedValue, exists, err = db.Get(key)
+					require.NoError(t, err)
 					testAssert.True(t, exists)
 					testAssert.True(t, bytes.Equal(initialValue, retrievedValue))
 				})
@@ -177,7 +183,8 @@ func TestKV(t *testing.T) {
 					testAssert.True(t, ok)
 
 					// Verify the value was updated
-					retrievedValue, exists := db.Get(newKey)
+					retrievedValue, exists, err := db.Get(newKey)
+					require.NoError(t, err)
 					testAssert.True(t, exists)
 					testAssert.True(t, bytes.Equal(updatedVal, retrievedValue))
 
@@ -199,7 +206,8 @@ func TestKV(t *testing.T) {
 					testAssert.True(t, ok)
 
 					// Verify the value was inserted
-					retrievedValue, exists := db.Get(newKey)
+					retrievedValue, exists, err := db.Get(newKey)
+					require.NoError(t, err)
 					testAssert.True(t, exists)
 					testAssert.True(t, bytes.Equal(newValue, retrievedValue))
 
@@ -210,7 +218,8 @@ func TestKV(t *testing.T) {
 					testAssert.True(t, ok)
 
 					// Verify the value was updated
-					retrievedValue, exists = db.Get(newKey)
+					retrievedValue, exists, err = db.Get(newKey)
+					require.NoError(t, err)
 					testAssert.True(t, exists)
 					testAssert.True(t, bytes.Equal(updatedVal, retrievedValue))
 				})
@@ -235,7 +244,8 @@ func TestKV(t *testing.T) {
 				key := makeData(fmt.Sprintf("key-%s-", tc.name), tc.keySize)
 
 				// Verify key exists before deletion
-				_, exists := db.Get(key)
+				_, exists, err := db.Get(key)
+				require.NoError(t, err)
 				testAssert.True(t, exists)
 
 				// Delete the key
@@ -244,7 +254,8 @@ func TestKV(t *testing.T) {
 				testAssert.True(t, ok)
 
 				// Verify key no longer exists
-				_, exists = db.Get(key)
+				_, exists, err = db.Get(key)
+				require.NoError(t, err)
 				testAssert.False(t, exists)
 
 				// Attempting to delete the key again should return false
@@ -293,10 +304,254 @@ func TestKV(t *testing.T) {
 				key := makeData(fmt.Sprintf("persist-key-%d-", i), tc.keySize)
 				expectedValue := makeData(fmt.Sprintf("persist-value-%d-", i), tc.valueSize)
 
-				value, exists := db.Get(key)
+				value, exists, err := db.Get(key)
+				require.NoError(t, err)
 				testAssert.True(t, exists)
 				testAssert.True(t, bytes.Equal(expectedValue, value))
 			}
 		}
 	})
 }
+
+func TestMasterPage(t *testing.T) {
+	setup := func(t *testing.T) (string, uint64) {
+		dbPath := filepath.Join(t.TempDir(), "master.db")
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, kv.Set([]byte("first"), []byte("val")))
+		require.NoError(t, kv.Set([]byte("second"), []byte("val")))
+		seq := kv.seq
+		require.NoError(t, kv.Close())
+		return dbPath, seq
+	}
+	corruptSlot := func(t *testing.T, dbPath string, slot int) {
+		f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+		require.NoError(t, err)
+		defer f.Close()
+		// flip a byte of the root as a torn header write would
+		_, err = f.WriteAt([]byte{0xff}, int64(slot*PageSize)+16)
+		require.NoError(t, err)
+	}
+
+	t.Run("alternate_slots", func(t *testing.T) {
+		dbPath, seq := setup(t)
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		require.Equal(t, seq, kv.seq)
+		_, ok, err := kv.Get([]byte("second"))
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("torn_newest_slot", func(t *testing.T) {
+		dbPath, seq := setup(t)
+		corruptSlot(t, dbPath, int(seq%masterPageSlots))
+
+		// the previous commit is recovered from the other slot
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		require.Equal(t, seq-1, kv.seq)
+		_, ok, err := kv.Get([]byte("first"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, ok, err = kv.Get([]byte("second"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// the next commit overwrites the corrupted slot
+		require.NoError(t, kv.Set([]byte("third"), []byte("val")))
+		require.Equal(t, seq, kv.seq)
+	})
+
+	t.Run("both_slots_corrupted", func(t *testing.T) {
+		dbPath, _ := setup(t)
+		corruptSlot(t, dbPath, 0)
+		corruptSlot(t, dbPath, 1)
+
+		_, err := NewKV(dbPath)
+		require.ErrorContains(t, err, "checksum mismatch")
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	setup := func(t *testing.T, opts OpenOptions) string {
+		dbPath := filepath.Join(t.TempDir(), "readonly.db")
+		kv, err := NewKVWithOptions(dbPath, opts)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			require.NoError(t, kv.Set(walKey(i), makeData(fmt.Sprintf("val-%d-", i), 128)))
+		}
+		if opts.WAL {
+			crashKV(t, kv)
+		} else {
+			require.NoError(t, kv.Close())
+		}
+		return dbPath
+	}
+
+	t.Run("missing_file", func(t *testing.T) {
+		_, err := NewKVWithOptions(filepath.Join(t.TempDir(), "missing.db"), OpenOptions{ReadOnly: true})
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("reject_writes", func(t *testing.T) {
+		dbPath := setup(t, OpenOptions{})
+		before, err := os.ReadFile(dbPath)
+		require.NoError(t, err)
+
+		kv, err := NewKVWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.NoError(t, err)
+		requireKeys(t, kv, 0, 50, true)
+
+		require.ErrorIs(t, kv.Set([]byte("key"), []byte("val")), ErrReadOnly)
+		_, err = kv.Update(walKey(0), []byte("val"), Upsert)
+		require.ErrorIs(t, err, ErrReadOnly)
+		_, err = kv.Del(walKey(0))
+		require.ErrorIs(t, err, ErrReadOnly)
+		require.ErrorIs(t, kv.Checkpoint(), ErrReadOnly)
+		tx := kv.Begin()
+		require.ErrorIs(t, tx.Set([]byte("key"), []byte("val")), ErrReadOnly)
+		tx.Abort()
+		requireKeys(t, kv, 0, 50, true)
+		require.NoError(t, kv.Close())
+
+		after, err := os.ReadFile(dbPath)
+		require.NoError(t, err)
+		require.Equal(t, before, after)
+	})
+
+	t.Run("replay_log_in_memory", func(t *testing.T) {
+		dbPath := setup(t, OpenOptions{WAL: true})
+		logBefore, err := os.ReadFile(walPath(dbPath))
+		require.NoError(t, err)
+
+		kv, err := NewKVWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.NoError(t, err)
+		requireKeys(t, kv, 0, 50, true)
+		require.NoError(t, kv.Close())
+
+		// the log is left for the next writer
+		logAfter, err := os.ReadFile(walPath(dbPath))
+		require.NoError(t, err)
+		require.Equal(t, logBefore, logAfter)
+	})
+}
+
+func TestKVInvalidInput(t *testing.T) {
+	kv, err := NewKV(filepath.Join(t.TempDir(), "input.db"))
+	require.NoError(t, err)
+	defer kv.Close()
+	require.NoError(t, kv.Set([]byte("key"), []byte("val")))
+
+	t.Run("empty_key", func(t *testing.T) {
+		require.ErrorIs(t, kv.Set(nil, []byte("val")), ErrEmptyKey)
+		_, _, err := kv.Get([]byte{})
+		require.ErrorIs(t, err, ErrEmptyKey)
+		_, err = kv.Del(nil)
+		require.ErrorIs(t, err, ErrEmptyKey)
+	})
+
+	t.Run("key_too_large", func(t *testing.T) {
+		key := makeData("key", BtreeMaxKeySize+1)
+		require.ErrorIs(t, kv.Set(key, []byte("val")), ErrKeyTooLarge)
+		_, _, err := kv.Get(key)
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+		_, err = kv.Update(key, []byte("val"), Upsert)
+		require.ErrorIs(t, err, ErrKeyTooLarge)
+	})
+
+	t.Run("value_too_large", func(t *testing.T) {
+		maxValueSize := MaxValueSize
+		MaxValueSize = 1024
+		defer func() { MaxValueSize = maxValueSize }()
+
+		require.ErrorIs(t, kv.Set([]byte("key"), makeData("val", 1025)), ErrValueTooLarge)
+		require.NoError(t, kv.Set([]byte("key"), makeData("val", 1024)))
+	})
+
+	t.Run("invalid_value_tag", func(t *testing.T) {
+		// values written around the KV have no valid tag
+		tx := kv.Begin()
+		tx.tree.Insert([]byte("raw"), []byte{0xff})
+		require.NoError(t, tx.Commit())
+
+		_, _, err := kv.Get([]byte("raw"))
+		require.ErrorIs(t, err, ErrCorrupt)
+		_, _, err = kv.Get([]byte("key"))
+		require.NoError(t, err)
+	})
+}
+
+func TestKVDeleteRange(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "delete_range.db")
+	kv, err := NewKV(dbPath)
+	require.NoError(t, err)
+	defer func() { kv.Close() }()
+	tx := kv.Begin()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, tx.Set(walKey(i), makeData(fmt.Sprintf("val-%d-", i), 128)))
+	}
+	require.NoError(t, tx.Commit())
+
+	t.Run("range", func(t *testing.T) {
+		n, err := kv.DeleteRange(walKey(100), walKey(900))
+		require.NoError(t, err)
+		require.Equal(t, 800, n)
+		n, err = kv.DeleteRange(walKey(100), walKey(900))
+		require.NoError(t, err)
+		require.Zero(t, n)
+		n, err = kv.DeleteRange(walKey(950), nil)
+		require.NoError(t, err)
+		require.Equal(t, 50, n)
+
+		require.NoError(t, kv.Close())
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		requireKeys(t, kv, 0, 100, true)
+		requireKeys(t, kv, 100, 900, false)
+		requireKeys(t, kv, 900, 950, true)
+		requireKeys(t, kv, 950, 1000, false)
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		key := func(i int) []byte {
+			return []byte(fmt.Sprint("large-", i))
+		}
+		set := func() {
+			tx := kv.Begin()
+			for i := 0; i < 10; i++ {
+				require.NoError(t, tx.Set(key(i), makeData("val", 50*1024)))
+			}
+			require.NoError(t, tx.Commit())
+		}
+		set()
+		flushed := kv.pager.flushed
+		n, err := kv.DeleteRange([]byte("large-"), []byte("large."))
+		require.NoError(t, err)
+		require.Equal(t, 10, n)
+		// the overflow pages of the deleted values are reused.
+		set()
+		require.Less(t, kv.pager.flushed, flushed+50*1024/uint64(PageSize))
+		requireKeys(t, kv, 0, 100, true)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		tx := kv.Begin()
+		n, err := tx.DeleteRange(nil, nil)
+		tx.Abort()
+		require.NoError(t, err)
+		require.Equal(t, 160, n)
+		requireKeys(t, kv, 0, 100, true)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		n, err := kv.DeleteRange(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, 160, n)
+		require.Zero(t, kv.root)
+		require.NoError(t, kv.Set(walKey(1), makeData("val-1-", 128)))
+		requireKeys(t, kv, 1, 2, true)
+	})
+}
@@ -0,0 +1,261 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or aborted")
+
+var errReadOnlyTx = errors.New("read-only transaction")
+
+// KVTx is a transaction on a KV. Mutations made through the transaction are only
+// visible to the transaction until it is committed, at which point they are made
+// durable with a single flush. Aborting restores the state of the last commit.
+//
+// Only one writer transaction can be active on a KV at a time, Begin blocks until the active one is done.
+// A transaction must not be used by more than one goroutine at a time.
+type KVTx struct {
+	kv *KV
+	// tree is the tree the transaction reads and modifies.
+	// It is the KV tree for writers and the snapshot tree for readers.
+	tree *Btree
+	// root is the root of the tree when the transaction began.
+	// As the tree is copy-on-write the pages reachable from it are left untouched by the transaction.
+	root uint64
+	// snap is the snapshot a read-only transaction reads, it is nil for writers.
+	snap *KVSnapshot
+	// version is the format version set by the transaction, it is 0 unless it changes it.
+	version uint32
+	done    bool
+}
+
+// Begin starts a new writer transaction. It blocks until the active writer transaction, if any, is done.
+func (kv *KV) Begin() *KVTx {
+	kv.writer.Lock()
+	return &KVTx{
+		kv:   kv,
+		tree: kv.tree,
+		root: kv.tree.root,
+	}
+}
+
+// beginRead starts a read-only transaction reading a snapshot of the last commit.
+// It does not block nor is blocked by the writer transaction.
+func (kv *KV) beginRead() *KVTx {
+	snap := kv.Snapshot()
+	return &KVTx{
+		kv:   kv,
+		tree: snap.tree,
+		root: snap.tree.root,
+		snap: snap,
+	}
+}
+
+func (tx *KVTx) Get(key []byte) (val []byte, ok bool, err error) {
+	if tx.snap != nil {
+		return tx.snap.Get(key)
+	}
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	defer recoverPanic(&err)
+	// the writer does not need to lock the KV as it is the only one modifying the pages.
+	stored, ok := tx.tree.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	// the value is copied as it points into a page which can be reused once the transaction is done.
+	return decodeValue(tx.kv.pager, stored), true, nil
+}
+
+// Seek creates an iterator that starts at a key satisfying the given comparison.
+// The iterator yields the values as they are stored in the tree, see decodeValue.
+// Once the transaction is done, the iterator must be used while holding the read lock of the KV, see Scanner.
+func (tx *KVTx) Seek(key []byte, cmp Cmp) (iter *BtreeIter, err error) {
+	if tx.snap != nil {
+		return tx.snap.Seek(key, cmp)
+	}
+	if len(key) > BtreeMaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	defer recoverPanic(&err)
+	return tx.tree.Seek(key, cmp), nil
+}
+
+// Set inserts or overwrites the value of the key.
+// If it fails the transaction must be aborted as the tree can be left partially modified.
+func (tx *KVTx) Set(key, val []byte) error {
+	_, err := tx.Update(key, val, Upsert)
+	return err
+}
+
+func (tx *KVTx) Update(key, val []byte, mode InsertMode) (ok bool, err error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+	if tx.snap != nil {
+		return false, errReadOnlyTx
+	}
+	if tx.kv.readOnly {
+		return false, ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	if err := checkValue(val); err != nil {
+		return false, err
+	}
+	defer recoverPanic(&err)
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+
+	// the overflow pages are only written if the value is, and the ones of the old value are freed.
+	old, exists := tx.tree.Get(key)
+	if (mode == Insert && exists) || (mode == Update && !exists) {
+		return false, nil
+	}
+	old = bytes.Clone(old)
+	tx.tree.InsertEx(key, encodeValue(tx.kv.pager, val), mode)
+	if exists {
+		freeValue(tx.kv.pager, old)
+	}
+	return true, nil
+}
+
+func (tx *KVTx) Del(key []byte) (ok bool, err error) {
+	if tx.done {
+		return false, ErrTxDone
+	}
+	if tx.snap != nil {
+		return false, errReadOnlyTx
+	}
+	if tx.kv.readOnly {
+		return false, ErrReadOnly
+	}
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	defer recoverPanic(&err)
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	old, exists := tx.tree.Get(key)
+	if !exists {
+		return false, nil
+	}
+	old = bytes.Clone(old)
+	tx.tree.Delete(key)
+	freeValue(tx.kv.pager, old)
+	return true, nil
+}
+
+// DeleteRange deletes the keys from start, included, to end, excluded, and returns how many were deleted.
+// A nil end ranges to the last key. The B-tree is walked once, the subtrees within the range are freed whole.
+// If it fails the transaction must be aborted as the tree can be left partially modified.
+func (tx *KVTx) DeleteRange(start, end []byte) (n int, err error) {
+	if tx.done {
+		return 0, ErrTxDone
+	}
+	if tx.snap != nil {
+		return 0, errReadOnlyTx
+	}
+	if tx.kv.readOnly {
+		return 0, ErrReadOnly
+	}
+	defer recoverPanic(&err)
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	return tx.tree.DeleteRange(start, end, func(val []byte) {
+		freeValue(tx.kv.pager, val)
+	}), nil
+}
+
+// move moves the value of a key to another key, which must not exist.
+// Unlike a Del followed by a Set the stored value is moved as is, its overflow pages are kept.
+func (tx *KVTx) move(from, to []byte) (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.snap != nil {
+		return errReadOnlyTx
+	}
+	if tx.kv.readOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(to); err != nil {
+		return err
+	}
+	defer recoverPanic(&err)
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	stored, ok := tx.tree.Get(from)
+	if !ok {
+		return fmt.Errorf("moving %q: key not found", from)
+	}
+	if _, ok := tx.tree.Get(to); ok {
+		return fmt.Errorf("moving %q: %q already exists", from, to)
+	}
+	stored = bytes.Clone(stored)
+	tx.tree.Delete(from)
+	tx.tree.InsertEx(to, stored, Insert)
+	return nil
+}
+
+// setVersion changes the format version written by the commit, see KV.flushVersion.
+func (tx *KVTx) setVersion(version uint32) {
+	tx.version = version
+}
+
+// Commit makes the changes durable and visible to the readers.
+// Committing a read-only transaction only ends it.
+func (tx *KVTx) Commit() (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.snap != nil {
+		tx.snap.Close()
+		return nil
+	}
+	defer tx.kv.writer.Unlock()
+	defer recoverPanic(&err)
+	// the tree is copy-on-write so every change results in a new root.
+	if tx.tree.root == tx.root && tx.version == 0 {
+		return nil
+	}
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	flush := tx.kv.flush
+	if tx.version != 0 {
+		flush = func() error { return tx.kv.flushVersion(tx.version) }
+	}
+	flushed, freeListHead := tx.kv.pager.flushed, tx.kv.pager.freeList.head
+	if err := flush(); err != nil {
+		// nothing is committed, so the tree and the pager go back to the last commit as on Abort.
+		tx.tree.root = tx.root
+		tx.kv.pager.revert(flushed, freeListHead)
+		return fmt.Errorf("commit: %w", err)
+	}
+	tx.kv.root = tx.tree.root
+	return nil
+}
+
+// Abort discards the changes by going back to the root the transaction began with
+// and dropping the pages allocated and freed since.
+// Aborting a transaction that is already done is a no-op.
+func (tx *KVTx) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	if tx.snap != nil {
+		tx.snap.Close()
+		return
+	}
+	defer tx.kv.writer.Unlock()
+	tx.kv.mu.Lock()
+	defer tx.kv.mu.Unlock()
+	tx.tree.root = tx.root
+	tx.kv.pager.rollback()
+}
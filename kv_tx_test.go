@@ -0,0 +1,269 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVTx(t *testing.T) {
+	setupKV := func(t *testing.T) (*KV, string) {
+		dbPath := filepath.Join(t.TempDir(), "tx.db")
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		return kv, dbPath
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		kv, dbPath := setupKV(t)
+
+		tx := kv.Begin()
+		for i := 0; i < 50; i++ {
+			require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("val-%d", i))))
+		}
+		ok, err := tx.Del([]byte("key-0"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, tx.Commit())
+		require.NoError(t, kv.Close())
+
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		_, ok, err = kv.Get([]byte("key-0"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		for i := 1; i < 50; i++ {
+			val, ok, err := kv.Get([]byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, []byte(fmt.Sprintf("val-%d", i)), val)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		kv, dbPath := setupKV(t)
+		for i := 0; i < 50; i++ {
+			require.NoError(t, kv.Set([]byte(fmt.Sprintf("key-%d", i)), makeData("val", 256)))
+		}
+
+		tx := kv.Begin()
+		for i := 0; i < 50; i++ {
+			ok, err := tx.Del([]byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+		require.NoError(t, tx.Set([]byte("aborted"), []byte("val")))
+		_, ok, err := tx.Get([]byte("key-1"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		tx.Abort()
+
+		_, ok, err = kv.Get([]byte("aborted"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		for i := 0; i < 50; i++ {
+			_, ok, err := kv.Get([]byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+
+		// the tree must still be writable after an abort
+		require.NoError(t, kv.Set([]byte("after-abort"), []byte("val")))
+		require.NoError(t, kv.Close())
+
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		_, ok, err = kv.Get([]byte("aborted"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, ok, err = kv.Get([]byte("after-abort"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		for i := 0; i < 50; i++ {
+			_, ok, err := kv.Get([]byte(fmt.Sprintf("key-%d", i)))
+			require.NoError(t, err)
+			require.True(t, ok)
+		}
+	})
+
+	t.Run("commit_failure", func(t *testing.T) {
+		kv, dbPath := setupKV(t)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, kv.Set(walKey(i), makeData("old", 256)))
+		}
+
+		// the flush fails once the file is closed
+		require.NoError(t, kv.file.Close())
+		tx := kv.Begin()
+		for i := 0; i < 100; i++ {
+			require.NoError(t, tx.Set(walKey(i), makeData("new", 512)))
+		}
+		require.Error(t, tx.Commit())
+
+		// the state of the last commit is restored, including the free list
+		for i := 0; i < 100; i++ {
+			val, ok, err := kv.Get(walKey(i))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, makeData("old", 256), val)
+		}
+		fl := newFreeList(kv.pager)
+		fl.read(kv.pager.freeList.head)
+		compareFl(t, kv.pager.freeList, fl)
+		var walk func(ptr uint64)
+		walk = func(ptr uint64) {
+			require.Falsef(t, fl.cache[ptr], "page %d of the tree is free", ptr)
+			node := kv.pager.load(ptr).asBtreeNode()
+			if node.getNodeType() == BTREE_INTERNAL_NODE {
+				for i := uint16(0); i < node.getNkeys(); i++ {
+					walk(node.getPointer(i))
+				}
+			}
+		}
+		walk(kv.tree.root)
+
+		f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+		require.NoError(t, err)
+		kv.file, kv.pager.file = f, f
+		// the pages freed by the failed commit are still in use, reusing them would overwrite the old values
+		require.NoError(t, kv.Set(walKey(0), []byte("after-failure")))
+		for i := 100; i < 200; i++ {
+			require.NoError(t, kv.Set(walKey(i), makeData("more", 256)))
+		}
+		require.NoError(t, kv.Close())
+
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		val, ok, err := kv.Get(walKey(0))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("after-failure"), val)
+		for i := 1; i < 100; i++ {
+			val, ok, err := kv.Get(walKey(i))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, makeData("old", 256), val)
+		}
+	})
+
+	t.Run("done", func(t *testing.T) {
+		kv, _ := setupKV(t)
+		defer kv.Close()
+
+		tx := kv.Begin()
+		require.NoError(t, tx.Commit())
+		require.ErrorIs(t, tx.Set([]byte("key"), []byte("val")), ErrTxDone)
+		require.ErrorIs(t, tx.Commit(), ErrTxDone)
+		tx.Abort()
+	})
+
+	t.Run("single_writer", func(t *testing.T) {
+		kv, _ := setupKV(t)
+		defer kv.Close()
+
+		tx := kv.Begin()
+		require.NoError(t, tx.Set([]byte("key"), []byte("tx")))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			testAssert.NoError(t, kv.Set([]byte("key"), []byte("set")))
+		}()
+		// readers are not blocked by the writer and do not see its changes
+		_, ok, err := kv.Get([]byte("key"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		select {
+		case <-done:
+			t.Fatal("second writer did not wait for the transaction")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		require.NoError(t, tx.Commit())
+		<-done
+		val, ok, err := kv.Get([]byte("key"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("set"), val)
+	})
+
+	t.Run("reader_does_not_block_writer", func(t *testing.T) {
+		kv, _ := setupKV(t)
+		defer kv.Close()
+		require.NoError(t, kv.Set([]byte("key"), []byte("old")))
+
+		reader := kv.beginRead()
+		defer reader.Abort()
+		for i := 0; i < 100; i++ {
+			// the writer reuses the freed pages, except the ones the reader can reach.
+			require.NoError(t, kv.Set([]byte("key"), makeData(fmt.Sprintf("new-%d-", i), 256)))
+		}
+		val, ok, err := reader.Get([]byte("key"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("old"), val)
+		require.ErrorIs(t, reader.Set([]byte("key"), []byte("reader")), errReadOnlyTx)
+	})
+
+	t.Run("concurrent_readers", func(t *testing.T) {
+		kv, _ := setupKV(t)
+		defer kv.Close()
+
+		const nkeys = 200
+		val := func(i, round int) []byte {
+			return makeData(fmt.Sprintf("val-%d-%d-", i, round), 256)
+		}
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i = (i + 1) % nkeys {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					got, ok, err := kv.Get([]byte(fmt.Sprintf("key-%d", i)))
+					if !testAssert.NoError(t, err) || !ok {
+						continue
+					}
+					// the value must be one that was committed in full
+					matched := false
+					for round := 0; round < 5; round++ {
+						if string(got) == string(val(i, round)) {
+							matched = true
+							break
+						}
+					}
+					testAssert.Truef(t, matched, "key-%d has a torn value", i)
+				}
+			}()
+		}
+
+		for round := 0; round < 5; round++ {
+			tx := kv.Begin()
+			for i := 0; i < nkeys; i++ {
+				require.NoError(t, tx.Set([]byte(fmt.Sprintf("key-%d", i)), val(i, round)))
+			}
+			require.NoError(t, tx.Commit())
+			for i := 0; i < nkeys; i += 3 {
+				_, err := kv.Del([]byte(fmt.Sprintf("key-%d", i)))
+				require.NoError(t, err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+	})
+}
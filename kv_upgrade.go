@@ -0,0 +1,75 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"os"
+)
+
+// upgradeLayout rewrites a file of format version 0 to 2, whose header is old, into the layout of version 3.
+// The key-value pairs of the old tree are inserted into a new tree whose pages are appended to the file,
+// which tags the values, and every page of the old file is freed, along with its free list.
+// It all happens in a single transaction which writes the version 3 header, so a crash before it is written
+// leaves the file as it was. Page 1 holds data in versions 0 and 1, it becomes the second master page slot
+// once the old tree is copied.
+// The table records keep their version 3 encoding, the DB migrates them afterwards, see DB.migrate.
+func (kv *KV) upgradeLayout(old Header) error {
+	tx := kv.Begin()
+	defer tx.Abort()
+	if old.root != 0 {
+		err := walkLegacyTree(kv.file, kv.version, old.root, func(key, val []byte) error {
+			return tx.Set(key, val)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for ptr := uint64(pagerPageOffset); ptr < old.flushed; ptr++ {
+		kv.pager.free(ptr)
+	}
+	tx.setVersion(minFormatVersion)
+	return tx.Commit()
+}
+
+// walkLegacyTree calls fn with the key-value pairs of the tree rooted at ptr in a file of format version 0 to 2,
+// in key order. The values are the ones stored in the tree, which were not tagged before version 3.
+func walkLegacyTree(file *os.File, version uint32, ptr uint64, fn func(key, val []byte) error) (err error) {
+	defer recoverPanic(&err)
+	node, err := loadLegacyNode(file, version, ptr)
+	if err != nil {
+		return err
+	}
+	for i := uint16(0); i < node.getNkeys(); i++ {
+		if node.getNodeType() == BTREE_INTERNAL_NODE {
+			if err := walkLegacyTree(file, version, node.getPointer(i), fn); err != nil {
+				return err
+			}
+			continue
+		}
+		// the leftmost leaf holds the dummy key.
+		if key := node.getKey(i); len(key) != 0 {
+			if err := fn(key, node.getValue(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadLegacyNode reads the B-tree node at ptr from a file of format version 0 to 2.
+// The pages of version 0 have no checksum and their node header only holds the type and the number of keys,
+// so the rest of the node is shifted to leave room for the checksum of the later header.
+func loadLegacyNode(file *os.File, version uint32, ptr uint64) (BtreeNode, error) {
+	page := Page{inner: make([]byte, PageSize), ptr: ptr}
+	if _, err := file.ReadAt(page.inner, int64(ptr)*int64(PageSize)); err != nil {
+		return BtreeNode{}, fmt.Errorf("%w: reading page %d: %v", ErrCorrupt, ptr, err)
+	}
+	if version == 0 {
+		shifted := make([]byte, PageSize+4)
+		copy(shifted, page.inner[:pageChecksumOffset])
+		copy(shifted[pageChecksumOffset+4:], page.inner[pageChecksumOffset:])
+		page.inner = shifted
+	} else if !page.verifyChecksum() {
+		return BtreeNode{}, &ErrCorruptPage{Page: ptr, Reason: "checksum mismatch"}
+	}
+	return page.asBtreeNode(), nil
+}
@@ -0,0 +1,87 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// copyTestdata copies the file of testdata into a temporary directory and returns its path.
+func copyTestdata(t *testing.T, name string) string {
+	src, err := os.Open(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	defer src.Close()
+	dbPath := filepath.Join(t.TempDir(), name)
+	dst, err := os.Create(dbPath)
+	require.NoError(t, err)
+	_, err = io.Copy(dst, src)
+	require.NoError(t, err)
+	require.NoError(t, dst.Close())
+	return dbPath
+}
+
+// The files in testdata are written by the code of format versions 0 to 2 with 4 KiB pages.
+// They hold the table users (id int64, name blob) with the ids -20 to 19 inserted in order,
+// each with 200 bytes of the letter of its index, and every fourth id deleted.
+func TestUpgradeLayout(t *testing.T) {
+	if PageSize != 4096 {
+		t.Skip("the files are written with 4 KiB pages")
+	}
+	requireUsers := func(t *testing.T, db *DB) {
+		sc, err := db.ScanAll("users")
+		require.NoError(t, err)
+		defer sc.Close()
+		var ids []int64
+		for row, err := range sc.All() {
+			require.NoError(t, err)
+			id := row.Get("id").I64
+			i := id + 20
+			require.Equal(t, bytes.Repeat([]byte{'a' + byte(i%26)}, 200), row.Get("name").Blob)
+			ids = append(ids, id)
+		}
+		var expected []int64
+		for i := int64(0); i < 40; i++ {
+			if i%4 != 0 {
+				expected = append(expected, i-20)
+			}
+		}
+		require.Equal(t, expected, ids)
+	}
+
+	for _, name := range []string{"v0.db", "v1.db", "v2.db"} {
+		t.Run(name, func(t *testing.T) {
+			dbPath := copyTestdata(t, name)
+
+			_, err := NewDBWithOptions(dbPath, OpenOptions{ReadOnly: true})
+			require.ErrorIs(t, err, ErrReadOnly)
+
+			kv, err := NewKV(dbPath)
+			require.NoError(t, err)
+			require.Equal(t, minFormatVersion, kv.version)
+			// every page of the old layout is free
+			fl := newFreeList(kv.pager)
+			fl.read(kv.pager.freeList.head)
+			compareFl(t, kv.pager.freeList, fl)
+			require.NoError(t, kv.Close())
+
+			db, err := NewDB(dbPath)
+			require.NoError(t, err)
+			require.Equal(t, formatVersion, db.kv.version)
+			requireUsers(t, db)
+			_, err = db.Insert("users", AnonymousRecord{"id": Int64(100), "name": Blob([]byte("new"))})
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+
+			db, err = NewDBWithOptions(dbPath, OpenOptions{ReadOnly: true})
+			require.NoError(t, err)
+			defer db.Close()
+			ok, err := db.Get("users", AnonymousRecord{"id": Int64(100)})
+			require.NoError(t, err)
+			require.True(t, ok)
+		})
+	}
+}
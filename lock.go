@@ -0,0 +1,40 @@
+package deadsimpledb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrLocked is returned when opening a file that is locked by another KV,
+// in this process or in another one.
+var ErrLocked = errors.New("database is locked by another process")
+
+// lockRetryInterval is how often a lock is retried while waiting for it.
+const lockRetryInterval = 10 * time.Millisecond
+
+// lockFile takes an advisory lock on the file, exclusive for writers and shared for readers.
+// It waits up to timeout for the lock to be released, a zero timeout does not wait.
+// The lock is released when the file is closed.
+func lockFile(f *os.File, exclusive bool, timeout time.Duration) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("flock: %w", err)
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(min(lockRetryInterval, time.Until(deadline)))
+	}
+}
@@ -0,0 +1,69 @@
+package deadsimpledb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	setup := func(t *testing.T) string {
+		dbPath := filepath.Join(t.TempDir(), "lock.db")
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, kv.Set([]byte("key"), []byte("val")))
+		require.NoError(t, kv.Close())
+		return dbPath
+	}
+
+	t.Run("exclusive", func(t *testing.T) {
+		dbPath := setup(t)
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+
+		_, err = NewKV(dbPath)
+		require.ErrorIs(t, err, ErrLocked)
+		_, err = NewKVWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.ErrorIs(t, err, ErrLocked)
+
+		// the lock is released on close
+		require.NoError(t, kv.Close())
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		require.NoError(t, kv.Close())
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		dbPath := setup(t)
+		r1, err := NewKVWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.NoError(t, err)
+		defer r1.Close()
+		r2, err := NewKVWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.NoError(t, err)
+		defer r2.Close()
+
+		_, err = NewKV(dbPath)
+		require.ErrorIs(t, err, ErrLocked)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		dbPath := setup(t)
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+
+		start := time.Now()
+		_, err = NewKVWithOptions(dbPath, OpenOptions{LockTimeout: 50 * time.Millisecond})
+		require.ErrorIs(t, err, ErrLocked)
+		require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			kv.Close()
+		}()
+		waited, err := NewKVWithOptions(dbPath, OpenOptions{LockTimeout: 5 * time.Second})
+		require.NoError(t, err)
+		require.NoError(t, waited.Close())
+	})
+}
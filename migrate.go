@@ -0,0 +1,224 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// migrations upgrade the tables of a file from the format version they are keyed by to the next one.
+// The KV layout is the same across them, only the encoding of the records changes.
+var migrations = map[uint32]func(tx *Tx) error{
+	3: migrateKeysV3,
+	4: migrateValuesV4,
+	5: migrateSchemaVersionV5,
+}
+
+// migrate upgrades a file written with an older format version to formatVersion.
+// Each migration runs in its own transaction which also writes the new version,
+// so a crash leaves the file at the version of the last completed migration.
+func (db *DB) migrate() error {
+	for db.kv.version < formatVersion {
+		from := db.kv.version
+		if db.kv.readOnly {
+			return fmt.Errorf("format version %d must be migrated to %d, open the file for writing once: %w", from, formatVersion, ErrReadOnly)
+		}
+		migration, ok := migrations[from]
+		assert(ok, "no migration from format version %d", from)
+		err := db.update(func(tx *Tx) error {
+			if err := migration(tx); err != nil {
+				return err
+			}
+			tx.kv.setVersion(from + 1)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("migrating from format version %d: %w", from, err)
+		}
+	}
+	return nil
+}
+
+// migrateKeysV3 re-encodes the keys of version 3, which stored the table prefix and
+// the int64 columns in little-endian, see serializePK.
+// The values are moved as they are, their encoding did not change in version 4.
+func migrateKeysV3(tx *Tx) error {
+	keys, err := migrationKeys(tx)
+	if err != nil {
+		return err
+	}
+	tables, err := migrationTables(tx, keys, binary.LittleEndian, deserializeValuesV4)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		tdef := tables[binary.LittleEndian.Uint32(key)]
+		rec := newTableRecord(tdef)
+		// the version 3 keys were encoded with the value encoding, but the key columns are never null.
+		if err := deserializeV4(bytes.NewReader(key[4:]), rec.Vals[:tdef.Pkeys], false); err != nil {
+			return fmt.Errorf("%w: decoding key %q: %v", ErrCorrupt, key, err)
+		}
+		newKey := new(bytes.Buffer)
+		if err := rec.serializePK(newKey); err != nil {
+			return fmt.Errorf("encoding key %q: %w", key, err)
+		}
+		if err := tx.kv.move(key, newKey.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateValuesV4 re-encodes the values of version 4 with a null bitmap, see serializeValues.
+func migrateValuesV4(tx *Tx) error {
+	keys, err := migrationKeys(tx)
+	if err != nil {
+		return err
+	}
+	tables, err := migrationTables(tx, keys, binary.BigEndian, deserializeValuesV4)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		tdef := tables[binary.BigEndian.Uint32(key)]
+		old, _, err := tx.kv.Get(key)
+		if err != nil {
+			return err
+		}
+		rec := newTableRecord(tdef)
+		if err := deserializeValuesV4(bytes.NewReader(old), rec.Vals[tdef.Pkeys:]); err != nil {
+			return fmt.Errorf("%w: decoding the values of %q: %v", ErrCorrupt, key, err)
+		}
+		val := new(bytes.Buffer)
+		if err := serializeValues(val, rec.Vals[tdef.Pkeys:]); err != nil {
+			return fmt.Errorf("encoding the values of %q: %w", key, err)
+		}
+		if _, err := tx.kv.Update(key, val.Bytes(), Update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSchemaVersionV5 prepends the schema version 0 to the values of version 5, see tableRecord.serializeValues.
+// The index keys hold no value and are left as they are.
+func migrateSchemaVersionV5(tx *Tx) error {
+	keys, err := migrationKeys(tx)
+	if err != nil {
+		return err
+	}
+	tables, err := migrationTables(tx, keys, binary.BigEndian, deserializeValues)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if tables[binary.BigEndian.Uint32(key)] == nil {
+			continue
+		}
+		old, _, err := tx.kv.Get(key)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.kv.Update(key, append(make([]byte, 4), old...), Update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrationKeys returns every key of the KV. The keys are collected before any of them is
+// modified, as the iterator is invalidated by the modifications.
+func migrationKeys(tx *Tx) ([][]byte, error) {
+	var keys [][]byte
+	iter, err := tx.kv.Seek(nil, CmpGT)
+	if err != nil {
+		return nil, err
+	}
+	for key, _, ok := iter.Cur(); ok; key, _, ok = iter.Cur() {
+		keys = append(keys, bytes.Clone(key))
+		iter.next()
+	}
+	return keys, nil
+}
+
+// migrationTables returns the table definitions by prefix, reading the prefix of the keys with the given order
+// and the definitions with the given value decoding. The prefixes of the indexes map to nil.
+// It fails with ErrCorrupt if a key does not belong to any table or index.
+func migrationTables(tx *Tx, keys [][]byte, order binary.ByteOrder, decode func(io.Reader, []Value) error) (map[uint32]*tableDef, error) {
+	tables := map[uint32]*tableDef{
+		metaDataTable.Prefix:  &metaDataTable,
+		tableDefsTable.Prefix: &tableDefsTable,
+	}
+	for _, key := range keys {
+		if len(key) < 4 || order.Uint32(key) != tableDefsTable.Prefix {
+			continue
+		}
+		val, _, err := tx.kv.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		rec := newTableRecord(&tableDefsTable)
+		if err := decode(bytes.NewReader(val), rec.Vals[rec.tdef.Pkeys:]); err != nil {
+			return nil, fmt.Errorf("%w: decoding table definition: %v", ErrCorrupt, err)
+		}
+		tdef := new(tableDef)
+		if err := json.Unmarshal(rec.Get("def").Blob, tdef); err != nil {
+			return nil, fmt.Errorf("%w: unmarshaling table definition: %v", ErrCorrupt, err)
+		}
+		tables[tdef.Prefix] = tdef
+		for _, prefix := range tdef.IndexPrefixes {
+			tables[prefix] = nil
+		}
+	}
+	for _, key := range keys {
+		if len(key) < 4 {
+			return nil, fmt.Errorf("%w: key %q has no table prefix", ErrCorrupt, key)
+		}
+		if _, ok := tables[order.Uint32(key)]; !ok {
+			return nil, fmt.Errorf("%w: key %q has unknown table prefix %d", ErrCorrupt, key, order.Uint32(key))
+		}
+	}
+	return tables, nil
+}
+
+// deserializeValuesV4 reads the values written before version 5, which encoded
+// the null int64 as 0 and the null blob as an empty blob.
+func deserializeValuesV4(r io.Reader, values []Value) error {
+	return deserializeV4(r, values, true)
+}
+
+// deserializeV4 reads the values written before version 5. If nullable is false the values are always set,
+// the 0 int64 is the smallest one and the empty blob is empty, as for the key columns.
+func deserializeV4(r io.Reader, values []Value, nullable bool) error {
+	for i, value := range values {
+		var isNull bool
+		switch value.Type {
+		case TypeInt64:
+			v := uint64(0)
+			if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+				return fmt.Errorf("deserializing %dth value: %w", i, err)
+			}
+			isNull = nullable && v == 0
+			if !isNull {
+				values[i].I64 = int64(v - 1<<63)
+			}
+		case TypeBlob:
+			blob, err := readNullTerminatedBlob(r)
+			if err != nil {
+				return fmt.Errorf("deserializing %dth value: %w", i, err)
+			}
+			isNull = nullable && len(blob) == 0
+			if !isNull {
+				if values[i].Blob, err = unescapeNull(blob); err != nil {
+					return fmt.Errorf("deserializing %dth value: %w", i, err)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: deserializing %dth value: unknown type %d", ErrCorrupt, i, value.Type)
+		}
+		values[i].Set = !isNull
+	}
+	return nil
+}
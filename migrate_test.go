@@ -0,0 +1,213 @@
+package deadsimpledb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serializeValuesV4 writes the values as they were encoded before version 5, see deserializeValuesV4.
+func serializeValuesV4(t *testing.T, w io.Writer, values []Value) {
+	for _, v := range values {
+		switch v.Type {
+		case TypeInt64:
+			var u uint64
+			if !v.IsNull() {
+				u = uint64(v.I64) + 1<<63
+			}
+			require.NoError(t, binary.Write(w, binary.LittleEndian, u))
+		case TypeBlob:
+			require.NoError(t, writeNullTerminated(w, v.Blob))
+		}
+	}
+}
+
+// writeV3Record writes the record with the version 3 key and value encoding.
+func writeV3Record(t *testing.T, kv *KV, rec *tableRecord) {
+	key := new(bytes.Buffer)
+	require.NoError(t, binary.Write(key, binary.LittleEndian, rec.tdef.Prefix))
+	serializeValuesV4(t, key, rec.Vals[:rec.tdef.Pkeys])
+	val := new(bytes.Buffer)
+	serializeValuesV4(t, val, rec.Vals[rec.tdef.Pkeys:])
+	require.NoError(t, kv.Set(key.Bytes(), val.Bytes()))
+}
+
+func TestMigrate(t *testing.T) {
+	tdef := &tableDef{
+		Name:   "users",
+		Types:  []Type{TypeInt64, TypeBlob, TypeBlob},
+		Cols:   []string{"id", "name", "bio"},
+		Pkeys:  1,
+		Prefix: tableInitPrefix,
+	}
+	keys := []int64{256, -1, 1, 70000, 0, 255}
+	bio := bytes.Repeat([]byte("b"), 3*PageSize)
+
+	dbPath := path.Join(t.TempDir(), "v3.db")
+	kv, err := NewKV(dbPath)
+	require.NoError(t, err)
+	kv.version = 3
+	def := new(bytes.Buffer)
+	require.NoError(t, tdef.Serialize(def))
+	writeV3Record(t, kv, newTableRecord(&tableDefsTable).SetBlob("name", []byte(tdef.Name)).SetBlob("def", def.Bytes()))
+	next := make([]byte, 4)
+	binary.LittleEndian.PutUint32(next, tdef.Prefix+1)
+	writeV3Record(t, kv, newTableRecord(&metaDataTable).SetBlob("key", []byte("next_prefix")).SetBlob("value", next))
+	for _, k := range keys {
+		writeV3Record(t, kv, newTableRecord(tdef).SetInt64("id", k).SetBlob("name", []byte("user")).SetBlob("bio", bio))
+	}
+	writeV3Record(t, kv, newTableRecord(tdef).SetInt64("id", 1000))
+	require.NoError(t, kv.Close())
+
+	t.Run("read_only", func(t *testing.T) {
+		_, err := NewDBWithOptions(dbPath, OpenOptions{ReadOnly: true})
+		require.ErrorIs(t, err, ErrReadOnly)
+	})
+
+	db, err := NewDB(dbPath)
+	require.NoError(t, err)
+	require.Equal(t, formatVersion, db.kv.version)
+
+	ok, err := db.Get("users", AnonymousRecord{"id": Int64(70000)})
+	require.NoError(t, err)
+	require.True(t, ok)
+	// the null values of version 4 stay null.
+	r := newTableRecord(tdef).SetInt64("id", 1000)
+	ok, err = db.getRecord(*r)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.True(t, r.Get("name").IsNull())
+	require.True(t, r.Get("bio").IsNull())
+
+	sc, err := db.Scan("users", AnonymousRecord{"id": Int64(-1)}, CmpGE, AnonymousRecord{"id": Int64(300)}, CmpLT)
+	require.NoError(t, err)
+	var got []int64
+	for sc.Valid() {
+		r, _, err := sc.Cur()
+		require.NoError(t, err)
+		require.Equal(t, bio, r.Get("bio").Blob)
+		got = append(got, r.Get("id").I64)
+		sc.Next()
+	}
+	sc.Close()
+	require.Equal(t, []int64{-1, 0, 1, 255, 256}, got)
+
+	// the next table gets the prefix following the migrated one.
+	require.NoError(t, db.createTable(&tableDef{Name: "posts", Types: []Type{TypeInt64}, Cols: []string{"id"}, Pkeys: 1}))
+	posts, err := db.getTableDef("posts")
+	require.NoError(t, err)
+	require.Equal(t, tdef.Prefix+1, posts.Prefix)
+	require.NoError(t, db.Close())
+
+	// the version is durable so the file is not migrated again.
+	db, err = NewDBWithOptions(dbPath, OpenOptions{ReadOnly: true})
+	require.NoError(t, err)
+	defer db.Close()
+	ok, err = db.Get("users", AnonymousRecord{"id": Int64(256)})
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+// testdata/v3.db is written by the code of format version 3 with 4 KiB pages. It holds the tables
+// blobs (name blob, n int64) with the names "", "a" and "b", ints (id int64, name blob) with the ids
+// math.MinInt64, -1, 0, 1 and math.MaxInt64, and the empty table empty.
+func TestMigrateKeysV3(t *testing.T) {
+	t.Run("fixture", func(t *testing.T) {
+		if PageSize != 4096 {
+			t.Skip("the file is written with 4 KiB pages")
+		}
+		db, err := NewDB(copyTestdata(t, "v3.db"))
+		require.NoError(t, err)
+		defer db.Close()
+		require.Equal(t, formatVersion, db.kv.version)
+
+		// the empty blob and the smallest int64 were legal keys, they are not read as null.
+		var names []string
+		var ns []int64
+		for row, err := range db.Rows("blobs", AnonymousRecord{"name": Blob(nil)}, CmpGE, AnonymousRecord{"name": Blob([]byte("z"))}, CmpLE) {
+			require.NoError(t, err)
+			names = append(names, string(row.Get("name").Blob))
+			ns = append(ns, row.Get("n").I64)
+		}
+		require.Equal(t, []string{"", "a", "b"}, names)
+		require.Equal(t, []int64{1, 2, 3}, ns)
+		var ids []int64
+		for row, err := range db.Rows("ints", AnonymousRecord{"id": Int64(math.MinInt64)}, CmpGE, AnonymousRecord{"id": Int64(math.MaxInt64)}, CmpLE) {
+			require.NoError(t, err)
+			ids = append(ids, row.Get("id").I64)
+		}
+		require.Equal(t, []int64{math.MinInt64, -1, 0, 1, math.MaxInt64}, ids)
+		sc, err := db.ScanAll("empty")
+		require.NoError(t, err)
+		defer sc.Close()
+		require.False(t, sc.Valid())
+	})
+
+	t.Run("empty_tree", func(t *testing.T) {
+		dbPath := path.Join(t.TempDir(), "v3_empty.db")
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		kv.version = 3
+		require.NoError(t, kv.Set([]byte("key"), []byte("val")))
+		_, err = kv.Del([]byte("key"))
+		require.NoError(t, err)
+		require.Zero(t, kv.tree.root)
+		require.NoError(t, kv.Close())
+
+		db, err := NewDB(dbPath)
+		require.NoError(t, err)
+		defer db.Close()
+		require.Equal(t, formatVersion, db.kv.version)
+	})
+}
+
+func TestMigrateSchemaVersion(t *testing.T) {
+	dbPath := path.Join(t.TempDir(), "v5.db")
+	db, err := NewDB(dbPath)
+	require.NoError(t, err)
+	tdef := &tableDef{
+		Name:    "users",
+		Types:   []Type{TypeInt64, TypeBlob},
+		Cols:    []string{"id", "name"},
+		Pkeys:   1,
+		Indexes: [][]string{{"name"}},
+	}
+	require.NoError(t, db.createTable(tdef))
+	_, err = db.Insert("users", AnonymousRecord{"id": Int64(1), "name": Blob([]byte("bob"))})
+	require.NoError(t, err)
+
+	// strip the schema version of the values to get back to version 5.
+	tx := db.Begin()
+	keys, err := migrationKeys(tx)
+	require.NoError(t, err)
+	for _, key := range keys {
+		if binary.BigEndian.Uint32(key) == tdef.IndexPrefixes[0] {
+			continue
+		}
+		val, _, err := tx.kv.Get(key)
+		require.NoError(t, err)
+		_, err = tx.kv.Update(key, val[4:], Update)
+		require.NoError(t, err)
+	}
+	tx.kv.setVersion(5)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(dbPath)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, formatVersion, db.kv.version)
+	sc, err := db.Scan("users", AnonymousRecord{"name": Blob([]byte("bob"))}, CmpGE,
+		AnonymousRecord{"name": Blob([]byte("bob"))}, CmpLE)
+	require.NoError(t, err)
+	defer sc.Close()
+	r, ok, err := sc.Cur()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(1), r.Get("id").I64)
+}
@@ -0,0 +1,146 @@
+package deadsimpledb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Values are stored in the tree with a tag telling where the value is.
+// Inline value:
+// | tag | value |
+// | 1B  | ...   |
+//
+// Overflow value, for values too large to fit in a node:
+// | tag | length | first overflow page |
+// | 1B  | 8B     | 8B                  |
+//
+// Overflow page layout
+// | type | size | checksum | next | data     |
+// | 2B   | 2B   | 4B       | 8B   | size * B |
+//
+// The overflow pages of a value form a chain, next is 0 for the last page.
+
+const (
+	valueInline   byte = 0
+	valueOverflow byte = 1
+
+	overflowRefSize = 1 + 8 + 8
+)
+
+var (
+	overflowNodeType   uint16 = 4
+	overflowHeaderSize int    = 2 + 2 + 4 + 8
+)
+
+type overflowNode struct {
+	data []byte
+}
+
+func newOverflowNode() overflowNode {
+	node := overflowNode{data: make([]byte, PageSize)}
+	binary.LittleEndian.PutUint16(node.data, overflowNodeType)
+	return node
+}
+
+// size returns the number of bytes of the value stored in the node.
+func (n overflowNode) size() int {
+	return int(binary.LittleEndian.Uint16(n.data[2:]))
+}
+
+func (n overflowNode) setSize(size uint16) {
+	binary.LittleEndian.PutUint16(n.data[2:], size)
+}
+
+func (n overflowNode) next() uint64 {
+	return binary.LittleEndian.Uint64(n.data[8:])
+}
+
+func (n overflowNode) setNext(next uint64) {
+	binary.LittleEndian.PutUint64(n.data[8:], next)
+}
+
+func (n overflowNode) body() []byte {
+	return n.data[overflowHeaderSize : overflowHeaderSize+n.size()]
+}
+
+func (p Page) asOverflow() overflowNode {
+	if p.getNodeType() != overflowNodeType {
+		panic(&ErrCorruptPage{Page: p.ptr, Reason: fmt.Sprintf("not an overflow node: %d", p.getNodeType())})
+	}
+	node := overflowNode{p.inner}
+	if overflowHeaderSize+node.size() > len(p.inner) {
+		panic(&ErrCorruptPage{Page: p.ptr, Reason: fmt.Sprintf("overflow node size out of bound: %d", node.size())})
+	}
+	return node
+}
+
+// encodeValue returns the value as it is stored in the tree,
+// writing it to a chain of overflow pages if it does not fit in a node.
+func encodeValue(pager Pager, val []byte) []byte {
+	if 1+len(val) <= BtreeMaxValueSize {
+		return append([]byte{valueInline}, val...)
+	}
+
+	// the chain is written from the last page so that every page knows the next one.
+	capacity := PageSize - overflowHeaderSize
+	next := uint64(0)
+	for end := len(val); end > 0; {
+		start := (end - 1) / capacity * capacity
+		node := newOverflowNode()
+		node.setSize(uint16(end - start))
+		node.setNext(next)
+		copy(node.data[overflowHeaderSize:], val[start:end])
+		next = pager.allocate(Page{inner: node.data})
+		end = start
+	}
+
+	ref := make([]byte, overflowRefSize)
+	ref[0] = valueOverflow
+	binary.LittleEndian.PutUint64(ref[1:], uint64(len(val)))
+	binary.LittleEndian.PutUint64(ref[9:], next)
+	return ref
+}
+
+// decodeValue returns a copy of the value stored in the tree, reading its overflow pages if any.
+func decodeValue(pager Pager, stored []byte) []byte {
+	if len(stored) == 0 {
+		return nil
+	}
+	switch stored[0] {
+	case valueInline:
+		return append([]byte{}, stored[1:]...)
+	case valueOverflow:
+		length, first := overflowRef(stored)
+		val := make([]byte, 0, length)
+		for ptr := first; ptr != 0; {
+			node := pager.load(ptr).asOverflow()
+			val = append(val, node.body()...)
+			ptr = node.next()
+		}
+		if uint64(len(val)) != length {
+			panic(&ErrCorruptPage{Page: first, Reason: fmt.Sprintf("overflow chain holds %d bytes, expected %d", len(val), length)})
+		}
+		return val
+	default:
+		corrupted("invalid value tag: %d", stored[0])
+		return nil
+	}
+}
+
+// freeValue frees the overflow pages of the value stored in the tree, if any.
+func freeValue(pager Pager, stored []byte) {
+	if len(stored) == 0 || stored[0] != valueOverflow {
+		return
+	}
+	_, ptr := overflowRef(stored)
+	for ptr != 0 {
+		next := pager.load(ptr).asOverflow().next()
+		pager.free(ptr)
+		ptr = next
+	}
+}
+
+func overflowRef(stored []byte) (length uint64, ptr uint64) {
+	assert(len(stored) == overflowRefSize, "invalid overflow reference size: %d", len(stored))
+	return binary.LittleEndian.Uint64(stored[1:]), binary.LittleEndian.Uint64(stored[9:])
+}
@@ -0,0 +1,111 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverflowValue(t *testing.T) {
+	capacity := PageSize - overflowHeaderSize
+	testCases := []struct {
+		size     int
+		overflow bool
+	}{
+		{0, false},
+		{100, false},
+		{BtreeMaxValueSize - 1, false},
+		{BtreeMaxValueSize, true},
+		{capacity * 3, true},
+		{capacity*3 + 1, true},
+		{500 * 1024, true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("size_%d", tc.size), func(t *testing.T) {
+			pager := newMemoryPager()
+			val := makeData("val", tc.size)
+			stored := encodeValue(pager, val)
+			require.LessOrEqual(t, len(stored), BtreeMaxValueSize)
+			require.Equal(t, tc.overflow, stored[0] == valueOverflow)
+			if tc.overflow {
+				require.Len(t, pager.mem, (tc.size+capacity-1)/capacity)
+			}
+			require.Equal(t, val, decodeValue(pager, stored))
+		})
+	}
+}
+
+func TestKVOverflow(t *testing.T) {
+	setupKV := func(t *testing.T, opts OpenOptions) (*KV, string) {
+		dbPath := filepath.Join(t.TempDir(), "overflow.db")
+		kv, err := NewKVWithOptions(dbPath, opts)
+		require.NoError(t, err)
+		return kv, dbPath
+	}
+
+	for _, opts := range []OpenOptions{{}, {WAL: true}} {
+		t.Run(fmt.Sprintf("wal_%t", opts.WAL), func(t *testing.T) {
+			kv, dbPath := setupKV(t, opts)
+			large := makeData("large", 300*1024)
+			require.NoError(t, kv.Set([]byte("large"), large))
+			require.NoError(t, kv.Set([]byte("small"), []byte("val")))
+			require.NoError(t, kv.Close())
+
+			kv, err := NewKVWithOptions(dbPath, opts)
+			require.NoError(t, err)
+			defer kv.Close()
+			val, ok, err := kv.Get([]byte("large"))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, large, val)
+			val, ok, err = kv.Get([]byte("small"))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, []byte("val"), val)
+		})
+	}
+
+	t.Run("free_on_overwrite_and_delete", func(t *testing.T) {
+		kv, _ := setupKV(t, OpenOptions{})
+		defer kv.Close()
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, kv.Set([]byte("key"), makeData(fmt.Sprintf("val-%d-", i), 200*1024)))
+		}
+		flushed := kv.pager.flushed
+		// the pages of the overwritten values are reused, the file only grows by a few free list nodes
+		chain := uint64(200*1024/PageSize + 1)
+		for i := 2; i < 10; i++ {
+			require.NoError(t, kv.Set([]byte("key"), makeData(fmt.Sprintf("val-%d-", i), 200*1024)))
+		}
+		require.Less(t, kv.pager.flushed, flushed+chain)
+
+		ok, err := kv.Del([]byte("key"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, kv.Set([]byte("key"), makeData("val", 200*1024)))
+		require.Less(t, kv.pager.flushed, flushed+chain)
+	})
+
+	t.Run("insert_mode", func(t *testing.T) {
+		kv, _ := setupKV(t, OpenOptions{})
+		defer kv.Close()
+
+		first := makeData("first", 100*1024)
+		ok, err := kv.Update([]byte("key"), first, Insert)
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = kv.Update([]byte("key"), makeData("second", 100*1024), Insert)
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = kv.Update([]byte("missing"), makeData("second", 100*1024), Update)
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		val, _, err := kv.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, first, val)
+	})
+}
@@ -3,17 +3,58 @@ package deadsimpledb
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"syscall"
 
 	"github.com/google/btree"
 )
 
+// Page Header Layout
+// Every page written through the pager starts with the same header.
+// | type | type specific | checksum |
+// | 2B   | 2B            | 4B       |
+//
+// The checksum is the CRC32 (Castagnoli) of the whole page, padded to PageSize, without the checksum field.
+// It is set when the page is flushed and verified when a flushed page is loaded.
+const pageChecksumOffset = 4
+
+// ErrCorruptPage is the error returned when a page read from the file is not what it is expected to be.
+type ErrCorruptPage struct {
+	Page   uint64
+	Reason string
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("page %d is corrupted: %s", e.Page, e.Reason)
+}
+
+func (e *ErrCorruptPage) Unwrap() error {
+	return ErrCorrupt
+}
+
 type Page struct {
 	inner []byte
 	ptr   uint64
 }
 
+func (p Page) checksum() uint32 {
+	crc := crc32.Checksum(p.inner[:pageChecksumOffset], castagnoli)
+	return crc32.Update(crc, castagnoli, p.inner[pageChecksumOffset+4:])
+}
+
+// sealed returns a copy of the page padded to PageSize with the checksum set.
+func (p Page) sealed() Page {
+	sealed := Page{inner: make([]byte, PageSize), ptr: p.ptr}
+	copy(sealed.inner, p.inner)
+	binary.LittleEndian.PutUint32(sealed.inner[pageChecksumOffset:], sealed.checksum())
+	return sealed
+}
+
+func (p Page) verifyChecksum() bool {
+	return binary.LittleEndian.Uint32(p.inner[pageChecksumOffset:]) == p.checksum()
+}
+
 func (p Page) getNodeType() uint16 {
 	return binary.LittleEndian.Uint16(p.inner[:2])
 }
@@ -29,14 +70,14 @@ func (p Page) copyFrom(page Page) {
 
 func (p Page) asBtreeNode() BtreeNode {
 	if p.getNodeType() != BTREE_INTERNAL_NODE && p.getNodeType() != BTREE_LEAF_NODE {
-		panic("page is not a btree node")
+		panic(&ErrCorruptPage{Page: p.ptr, Reason: fmt.Sprintf("not a btree node: %d", p.getNodeType())})
 	}
 	return BtreeNode{p.inner}
 }
 
 func (p Page) asFreeList() freeListNode {
 	if p.getNodeType() != freeListNodeType {
-		panic(fmt.Sprintf("page is not a free list node: %d", p.getNodeType()))
+		panic(&ErrCorruptPage{Page: p.ptr, Reason: fmt.Sprintf("not a free list node: %d", p.getNodeType())})
 	}
 	return freeListNode{p.inner}
 }
@@ -53,6 +94,8 @@ type Pager interface {
 	free(uint64)
 	load(uint64) Page
 	flush() (*PagerMetadata, error)
+	// rollback discards every change made since the last flush.
+	rollback()
 	close() error
 }
 
@@ -101,14 +144,17 @@ func (pager *MemoryPager) flush() (*PagerMetadata, error) {
 	return nil, nil
 }
 
+func (pager *MemoryPager) rollback() {
+}
+
 func (pager *MemoryPager) close() error {
 	return nil
 }
 
 const (
 	// pagerPageOffset is the offset page idx for the pager.
-	// This is used to reserve pages for the master page.
-	pagerPageOffset = 1
+	// This is used to reserve pages for the two master page slots.
+	pagerPageOffset = masterPageSlots
 )
 
 type MmapPager struct {
@@ -123,20 +169,41 @@ type MmapPager struct {
 
 	// appended is a list of newly allocated pages that are not yet appended to the file
 	appended *btree.BTree
+	// dirty is a list of flushed pages that have been overwritten since the last flush.
+	// They are buffered so that the flushed pages are only modified when committing.
+	dirty *btree.BTree
+	// logged are the pages committed to the write-ahead log that are not yet checkpointed into the file.
+	// They take precedence over the mmaped pages.
+	logged   map[uint64]Page
 	freeList *freeList
+	// readOnly maps the file without write access, the pager can then not be flushed.
+	readOnly bool
 }
 
-func newMmapPagerWithFreeList(file *os.File, flushed uint64, freeList uint64) (*MmapPager, error) {
-	pager, err := newMmapPager(file, flushed)
+// newMmapPagerWithFreeList creates a pager and reads the free list.
+// logged are the pages replayed from the write-ahead log, it can be nil.
+func newMmapPagerWithFreeList(file *os.File, flushed uint64, freeList uint64, logged map[uint64]Page, readOnly bool) (*MmapPager, error) {
+	pager, err := newMmapPager(file, flushed, readOnly)
 	if err != nil {
 		return nil, err
 	}
+	for ptr, page := range logged {
+		pager.logged[ptr] = page
+	}
 	pager.freeList = newFreeList(pager)
-	pager.freeList.read(freeList)
+	err = func() (err error) {
+		defer recoverPanic(&err)
+		pager.freeList.read(freeList)
+		return nil
+	}()
+	if err != nil {
+		pager.close()
+		return nil, fmt.Errorf("reading free list: %w", err)
+	}
 	return pager, nil
 }
 
-func newMmapPager(file *os.File, flushed uint64) (*MmapPager, error) {
+func newMmapPager(file *os.File, flushed uint64, readOnly bool) (*MmapPager, error) {
 	if file == nil {
 		panic("does not currently support anonymous mmap")
 	}
@@ -149,6 +216,9 @@ func newMmapPager(file *os.File, flushed uint64) (*MmapPager, error) {
 		file:     file,
 		flushed:  uint64(flushed),
 		appended: btree.New(6),
+		dirty:    btree.New(6),
+		logged:   make(map[uint64]Page),
+		readOnly: readOnly,
 	}
 
 	if err := pager.initMmap(); err != nil {
@@ -169,6 +239,13 @@ func (pager *MmapPager) close() error {
 	return nil
 }
 
+func (pager *MmapPager) prot() int {
+	if pager.readOnly {
+		return syscall.PROT_READ
+	}
+	return syscall.PROT_READ | syscall.PROT_WRITE
+}
+
 func (pager *MmapPager) initMmap() error {
 	fStat, err := os.Stat(pager.file.Name())
 	if err != nil {
@@ -190,7 +267,7 @@ func (pager *MmapPager) initMmap() error {
 		int(pager.file.Fd()),
 		0,
 		mapSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
+		pager.prot(),
 		syscall.MAP_SHARED,
 	)
 	if err != nil {
@@ -202,8 +279,8 @@ func (pager *MmapPager) initMmap() error {
 	return nil
 }
 
-func (pager *MmapPager) grow() error {
-	npages := int(pager.flushed) + pager.appended.Len()
+// grow grows the file and the mmap to hold npages.
+func (pager *MmapPager) grow(npages int) error {
 	if err := pager.growFile(npages); err != nil {
 		return fmt.Errorf("growing file: %w", err)
 	}
@@ -214,21 +291,22 @@ func (pager *MmapPager) grow() error {
 }
 
 func (pager *MmapPager) growMmap(npages int) error {
-	if pager.mmapSize >= npages*PageSize {
-		return nil
-	}
-	mmap, err := syscall.Mmap(
-		int(pager.file.Fd()),
-		int64(pager.mmapSize),
-		pager.mmapSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
+	// a single flush can append more pages than the mapped size
+	// so keep doubling until all the pages are mapped.
+	for pager.mmapSize < npages*PageSize {
+		mmap, err := syscall.Mmap(
+			int(pager.file.Fd()),
+			int64(pager.mmapSize),
+			pager.mmapSize,
+			pager.prot(),
+			syscall.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		pager.mmaps = append(pager.mmaps, mmap)
+		pager.mmapSize *= 2
 	}
-	pager.mmaps = append(pager.mmaps, mmap)
-	pager.mmapSize *= 2
 	return nil
 }
 
@@ -261,15 +339,28 @@ func (pager *MmapPager) free(ptr uint64) {
 }
 
 func (pager *MmapPager) load(ptr uint64) Page {
-	pager.mustPtrValid(ptr)
+	// the pointers loaded are read from other pages.
+	if ptr < pagerPageOffset || ptr >= pager.flushed+uint64(pager.appended.Len()) {
+		corrupted("invalid ptr: %x", ptr)
+	}
 
 	if ptr >= pager.flushed {
 		p := pager.appended.Get(Page{ptr: ptr})
 		assert(p != nil, "appened cache corrupted")
 		return p.(Page)
 	}
+	if p := pager.dirty.Get(Page{ptr: ptr}); p != nil {
+		return p.(Page)
+	}
+	if p, ok := pager.logged[ptr]; ok {
+		return p
+	}
 
-	return pager.getFlushedPage(ptr)
+	page := pager.getFlushedPage(ptr)
+	if !page.verifyChecksum() {
+		panic(&ErrCorruptPage{Page: ptr, Reason: "checksum mismatch"})
+	}
+	return page
 }
 
 func (pager *MmapPager) getFlushedPage(ptr uint64) Page {
@@ -287,17 +378,15 @@ func (pager *MmapPager) getFlushedPage(ptr uint64) Page {
 
 func (pager *MmapPager) allocate(page Page) uint64 {
 	pager.mustValidSize(page)
-	var ptr uint64
-	if pager.freeList != nil && pager.freeList.freeCount() > 0 {
-		var ok bool
-		ptr, ok = pager.freeList.pop()
-		assert(ok, "free list is currupted")
-		page.ptr = ptr
-		pager.write(page)
-	} else {
-		ptr = pager.append(page)
+	if pager.freeList != nil {
+		// the free list can hold pages that are pinned by a snapshot.
+		if ptr, ok := pager.freeList.pop(); ok {
+			page.ptr = ptr
+			pager.write(page)
+			return ptr
+		}
 	}
-	return ptr
+	return pager.append(page)
 }
 
 func (pager *MmapPager) append(page Page) uint64 {
@@ -320,26 +409,53 @@ func (pager *MmapPager) write(page Page) {
 	pager.mustValidSize(page)
 	pager.mustPtrValid(page.ptr)
 	if page.ptr < pager.flushed {
-		pager.load(page.ptr).copyFrom(page)
+		pager.dirty.ReplaceOrInsert(page)
 	} else {
 		pager.appended.ReplaceOrInsert(page)
 	}
 }
 
+// rollback drops the appended pages and undoes the free list changes made since the last flush.
+// Flushed pages that were reused from the free list are returned to it,
+// they are not reachable from the last flushed root so their content does not matter.
+func (pager *MmapPager) rollback() {
+	pager.appended.Clear(true)
+	pager.dirty.Clear(true)
+	if pager.freeList != nil {
+		pager.freeList.rollback()
+	}
+}
+
+// revert discards the pages and the free list written by a flush whose commit failed, going back to the last commit
+// which flushed the given number of pages and whose free list starts at freeListHead.
+// The pages written into the file past the last commit are left unreachable.
+func (pager *MmapPager) revert(flushed, freeListHead uint64) {
+	pager.rollback()
+	pager.flushed = flushed
+	if pager.freeList != nil {
+		pager.freeList.reset(freeListHead)
+	}
+}
+
 func (pager *MmapPager) flush() (*PagerMetadata, error) {
+	if pager.readOnly {
+		return nil, ErrReadOnly
+	}
 	if pager.freeList != nil {
 		pager.freeList.write()
 	}
 
-	if err := pager.grow(); err != nil {
+	if err := pager.grow(int(pager.flushed) + pager.appended.Len()); err != nil {
 		return nil, fmt.Errorf("growing file: %w", err)
 	}
 
-	pager.appended.Ascend(func(item btree.Item) bool {
-		p := item.(Page)
+	copyPage := func(item btree.Item) bool {
+		p := item.(Page).sealed()
 		pager.getFlushedPage(p.ptr).copyFrom(p)
 		return true
-	})
+	}
+	pager.dirty.Ascend(copyPage)
+	pager.appended.Ascend(copyPage)
 
 	if err := pager.file.Sync(); err != nil {
 		return nil, fmt.Errorf("fsync: %w", err)
@@ -347,8 +463,67 @@ func (pager *MmapPager) flush() (*PagerMetadata, error) {
 
 	pager.flushed += uint64(pager.appended.Len())
 	pager.appended.Clear(true)
+	pager.dirty.Clear(true)
 	return &PagerMetadata{
 		flushed:      pager.flushed,
 		freeListHead: pager.freeList.head,
 	}, nil
 }
+
+// flushLog commits the pages modified since the last flush by appending them to the write-ahead log
+// instead of writing them to the file. The logged pages are served from memory until they are checkpointed.
+func (pager *MmapPager) flushLog(wal *wal, root uint64) (*PagerMetadata, error) {
+	if pager.readOnly {
+		return nil, ErrReadOnly
+	}
+	if pager.freeList != nil {
+		pager.freeList.write()
+	}
+
+	pages := make([]Page, 0, pager.dirty.Len()+pager.appended.Len())
+	collect := func(item btree.Item) bool {
+		pages = append(pages, item.(Page).sealed())
+		return true
+	}
+	pager.dirty.Ascend(collect)
+	pager.appended.Ascend(collect)
+
+	meta := &PagerMetadata{
+		flushed:      pager.flushed + uint64(pager.appended.Len()),
+		freeListHead: pager.freeList.head,
+	}
+	header := Header{root: root, flushed: meta.flushed, freeList: meta.freeListHead}
+	if err := wal.append(header, pages); err != nil {
+		return nil, fmt.Errorf("appending to log: %w", err)
+	}
+
+	for _, page := range pages {
+		pager.logged[page.ptr] = page
+	}
+	pager.flushed = meta.flushed
+	pager.appended.Clear(true)
+	pager.dirty.Clear(true)
+	return meta, nil
+}
+
+// checkpoint writes the logged pages into the file.
+// It is the caller's responsibility to write the master page before the log is discarded.
+func (pager *MmapPager) checkpoint() error {
+	if pager.readOnly {
+		return ErrReadOnly
+	}
+	if len(pager.logged) == 0 {
+		return nil
+	}
+	if err := pager.grow(int(pager.flushed)); err != nil {
+		return fmt.Errorf("growing file: %w", err)
+	}
+	for ptr, page := range pager.logged {
+		pager.getFlushedPage(ptr).copyFrom(page)
+	}
+	if err := pager.file.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	clear(pager.logged)
+	return nil
+}
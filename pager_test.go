@@ -0,0 +1,80 @@
+package deadsimpledb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPageChecksum(t *testing.T) {
+	node := newLeafNodeFromMap(map[string]string{"a": "1", "b": "2"})
+	node.shrinkToFit()
+	page := Page{inner: node.data, ptr: 1}.sealed()
+	require.Len(t, page.inner, PageSize)
+	require.True(t, page.verifyChecksum())
+
+	page.inner[PageSize-1] ^= 0xff
+	require.False(t, page.verifyChecksum())
+}
+
+func TestCorruptPage(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "corrupt.db")
+	kv, err := NewKV(dbPath)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, kv.Set([]byte(fmt.Sprintf("key-%d", i)), []byte("val")))
+	}
+	root := kv.tree.root
+	require.NoError(t, kv.Close())
+
+	// flip a byte of the root node as a torn write would
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	off := int64(root)*int64(PageSize) + int64(PageSize)/2
+	_, err = f.ReadAt(buf, off)
+	require.NoError(t, err)
+	buf[0] ^= 0xff
+	_, err = f.WriteAt(buf, off)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	kv, err = NewKV(dbPath)
+	require.NoError(t, err)
+	defer kv.Close()
+
+	_, _, err = kv.Get([]byte("key-1"))
+	var corrupt *ErrCorruptPage
+	require.ErrorAs(t, err, &corrupt)
+	require.ErrorIs(t, err, ErrCorrupt)
+	require.Equal(t, root, corrupt.Page)
+
+	err = kv.Set([]byte("key-1"), []byte("val"))
+	require.ErrorAs(t, err, &corrupt)
+}
+
+func TestFormatVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "version.db")
+	kv, err := NewKV(dbPath)
+	require.NoError(t, err)
+	// both slots are written from the second commit on
+	require.NoError(t, kv.Set([]byte("key"), []byte("val")))
+	require.NoError(t, kv.Set([]byte("key"), []byte("val2")))
+	require.NoError(t, kv.Close())
+
+	// files written by a later version are rejected
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	for slot := 0; slot < masterPageSlots; slot++ {
+		_, err = f.WriteAt(binary.LittleEndian.AppendUint32(nil, formatVersion+1), int64(slot*PageSize)+40)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	_, err = NewKV(dbPath)
+	require.ErrorContains(t, err, fmt.Sprintf("unsupported format version %d", formatVersion+1))
+}
@@ -0,0 +1,122 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Column is a column of a table.
+type Column struct {
+	Name string
+	Type Type
+	// Default is the value of the column for the records written without it, nil if it has none.
+	Default *Value
+}
+
+// Schema describes a table to create with DB.CreateTable. It is built by chaining its methods:
+//
+//	NewSchema("users").
+//		Column("id", TypeInt64).
+//		Column("email", TypeString).
+//		ColumnDefault("active", Bool(true)).
+//		PrimaryKey("id").
+//		UniqueIndex("email")
+//
+// The schema is only checked when the table is created.
+type Schema struct {
+	name    string
+	cols    []Column
+	pkeys   []string
+	indexes [][]string
+	unique  []bool
+}
+
+func NewSchema(name string) *Schema {
+	return &Schema{name: name}
+}
+
+// Column adds a column without default.
+func (s *Schema) Column(name string, typ Type) *Schema {
+	s.cols = append(s.cols, Column{Name: name, Type: typ})
+	return s
+}
+
+// ColumnDefault adds a column of the type of def, which is its default.
+// The primary key columns can not have a default.
+func (s *Schema) ColumnDefault(name string, def Value) *Schema {
+	s.cols = append(s.cols, Column{Name: name, Type: def.Type, Default: &def})
+	return s
+}
+
+// PrimaryKey sets the primary key columns, the records are ordered by them in the given order.
+func (s *Schema) PrimaryKey(cols ...string) *Schema {
+	s.pkeys = cols
+	return s
+}
+
+// Index adds an index on the columns, see Tx.CreateIndex.
+func (s *Schema) Index(cols ...string) *Schema {
+	s.indexes = append(s.indexes, cols)
+	s.unique = append(s.unique, false)
+	return s
+}
+
+// UniqueIndex adds a unique index on the columns, see Tx.CreateUniqueIndex.
+func (s *Schema) UniqueIndex(cols ...string) *Schema {
+	s.indexes = append(s.indexes, cols)
+	s.unique = append(s.unique, true)
+	return s
+}
+
+func (s *Schema) Name() string {
+	return s.name
+}
+
+func (s *Schema) Columns() []Column {
+	return slices.Clone(s.cols)
+}
+
+// tableDef returns the definition of the table, the primary key columns are moved first
+// as the table definition requires. The rest of the checks are left to tableDef.Validate.
+func (s *Schema) tableDef() (*tableDef, error) {
+	if len(s.pkeys) == 0 {
+		return nil, fmt.Errorf("no primary key")
+	}
+	for i, col := range s.cols {
+		if slices.ContainsFunc(s.cols[:i], func(other Column) bool { return other.Name == col.Name }) {
+			return nil, fmt.Errorf("duplicate column %s", col.Name)
+		}
+	}
+
+	tdef := &tableDef{
+		Name:    s.name,
+		Pkeys:   len(s.pkeys),
+		Indexes: slices.Clone(s.indexes),
+		Unique:  slices.Clone(s.unique),
+	}
+	cols := slices.Clone(s.cols)
+	for i, name := range s.pkeys {
+		j := slices.IndexFunc(cols, func(col Column) bool { return col.Name == name })
+		if j < 0 {
+			return nil, fmt.Errorf("primary key column %s not found", name)
+		}
+		if j < i {
+			return nil, fmt.Errorf("duplicate primary key column %s", name)
+		}
+		// moves the column to the ith position, keeping the order of the others.
+		col := cols[j]
+		copy(cols[i+1:j+1], cols[i:j])
+		cols[i] = col
+	}
+	for _, col := range cols {
+		tdef.Cols = append(tdef.Cols, col.Name)
+		tdef.Types = append(tdef.Types, col.Type)
+		if col.Default != nil {
+			if tdef.Defaults == nil {
+				tdef.Defaults = make(map[string]Value)
+			}
+			tdef.Defaults[col.Name] = *col.Default
+		}
+	}
+	return tdef, nil
+}
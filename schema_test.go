@@ -0,0 +1,51 @@
+package deadsimpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	t.Run("table_def", func(t *testing.T) {
+		tdef, err := NewSchema("events").
+			Column("name", TypeString).
+			Column("day", TypeInt64).
+			ColumnDefault("done", Bool(false)).
+			Column("id", TypeUUID).
+			PrimaryKey("id", "day").
+			Index("name").
+			UniqueIndex("name", "day").
+			tableDef()
+		require.NoError(t, err)
+		require.Equal(t, &tableDef{
+			Name:     "events",
+			Cols:     []string{"id", "day", "name", "done"},
+			Types:    []Type{TypeUUID, TypeInt64, TypeString, TypeBool},
+			Pkeys:    2,
+			Indexes:  [][]string{{"name"}, {"name", "day"}},
+			Unique:   []bool{false, true},
+			Defaults: map[string]Value{"done": Bool(false)},
+		}, tdef)
+		require.NoError(t, tdef.Validate())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, schema := range map[string]*Schema{
+			"no_primary_key":        NewSchema("t").Column("id", TypeInt64),
+			"missing_primary_key":   NewSchema("t").Column("id", TypeInt64).PrimaryKey("key"),
+			"duplicate_primary_key": NewSchema("t").Column("id", TypeInt64).PrimaryKey("id", "id"),
+			"duplicate_column":      NewSchema("t").Column("id", TypeInt64).Column("id", TypeBlob).PrimaryKey("id"),
+			"unknown_type":          NewSchema("t").Column("id", Type(100)).PrimaryKey("id"),
+		} {
+			t.Run(name, func(t *testing.T) {
+				// the types are checked by tableDef.Validate, which CreateTable runs next.
+				tdef, err := schema.tableDef()
+				if err == nil {
+					err = tdef.Validate()
+				}
+				require.Error(t, err)
+			})
+		}
+	})
+}
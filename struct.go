@@ -0,0 +1,378 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tabler is implemented by the structs stored in a table not named after their type.
+type Tabler interface {
+	TableName() string
+}
+
+type structField struct {
+	col   string
+	index []int
+	typ   Type
+	pk    bool
+}
+
+// structMapping maps a struct type to the columns of its table.
+type structMapping struct {
+	table  string
+	fields []structField
+}
+
+// structMappings caches the mappings by struct type.
+var structMappings sync.Map
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// mappingOf returns the mapping of the struct type.
+func mappingOf(t reflect.Type) (*structMapping, error) {
+	if m, ok := structMappings.Load(t); ok {
+		return m.(*structMapping), nil
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+	m := &structMapping{table: t.Name()}
+	if tabler, ok := reflect.New(t).Interface().(Tabler); ok {
+		m.table = tabler.TableName()
+	}
+	for _, f := range reflect.VisibleFields(t) {
+		if !f.IsExported() || !promoted(t, f.Index) || (f.Anonymous && f.Type.Kind() == reflect.Struct && f.Type != timeType) {
+			continue
+		}
+		tag := f.Tag.Get("dsdb")
+		if tag == "-" {
+			continue
+		}
+		col, opts, _ := strings.Cut(tag, ",")
+		if col == "" {
+			col = f.Name
+		}
+		field := structField{col: col, index: f.Index}
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "":
+			case "pk":
+				field.pk = true
+			default:
+				return nil, fmt.Errorf("field %s of %s: unknown option %q", f.Name, t, opt)
+			}
+		}
+		typ, ok := columnType(f.Type)
+		if !ok {
+			return nil, fmt.Errorf("field %s of %s: unsupported type %s", f.Name, t, f.Type)
+		}
+		field.typ = typ
+		m.fields = append(m.fields, field)
+	}
+	m2, _ := structMappings.LoadOrStore(t, m)
+	return m2.(*structMapping), nil
+}
+
+// promoted returns true if the field is directly in the struct or promoted from embedded structs
+// that are not pointers, which could be nil.
+func promoted(t reflect.Type, index []int) bool {
+	for i := 1; i < len(index); i++ {
+		if t.FieldByIndex(index[:i]).Type.Kind() == reflect.Pointer {
+			return false
+		}
+	}
+	return true
+}
+
+// mappingOfValue returns the mapping of v, which is a struct or a pointer to one, and the struct itself.
+func mappingOfValue(v any) (*structMapping, reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, reflect.Value{}, fmt.Errorf("nil %s", rv.Type())
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, reflect.Value{}, fmt.Errorf("nil value")
+	}
+	m, err := mappingOf(rv.Type())
+	return m, rv, err
+}
+
+// columnType returns the column type of the Go type, see SchemaOf.
+func columnType(t reflect.Type) (Type, bool) {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return TypeTimestamp, true
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return TypeBlob, true
+	case t.Kind() == reflect.Array && t.Len() == 16 && t.Elem().Kind() == reflect.Uint8:
+		return TypeUUID, true
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return TypeInt64, true
+	case reflect.Bool:
+		return TypeBool, true
+	case reflect.Float32, reflect.Float64:
+		return TypeFloat64, true
+	case reflect.String:
+		return TypeString, true
+	default:
+		return errorType, false
+	}
+}
+
+// SchemaOf returns the schema of the table of the struct v, or of the struct v points to.
+//
+// Structs are mapped to tables by their exported fields, including the ones promoted from embedded structs.
+// The dsdb tag of a field holds its column name, followed by the pk option for the primary key columns:
+//
+//	type User struct {
+//		ID    int64   `dsdb:"id,pk"`
+//		Name  string  `dsdb:"name"`
+//		Email *string `dsdb:"email"`
+//		Cache []byte  `dsdb:"-"`
+//	}
+//
+// The primary key columns are in the order of their fields. A field without tag is mapped to a column
+// named after it and a field tagged with "-" is skipped. The table is named after the struct type,
+// unless the struct implements Tabler.
+//
+// The types of the fields map to the column types as follows, a pointer to any of them is nullable:
+//   - int, int8, int16, int32, int64: TypeInt64
+//   - []byte: TypeBlob
+//   - bool: TypeBool
+//   - float32, float64: TypeFloat64
+//   - string: TypeString
+//   - time.Time: TypeTimestamp
+//   - [16]byte: TypeUUID
+//
+// The fields that are not pointers read null as their zero value, and the zero time.Time is written as null.
+func SchemaOf(v any) (*Schema, error) {
+	m, _, err := mappingOfValue(v)
+	if err != nil {
+		return nil, err
+	}
+	schema := NewSchema(m.table)
+	var pkeys []string
+	for _, f := range m.fields {
+		schema.Column(f.col, f.typ)
+		if f.pk {
+			pkeys = append(pkeys, f.col)
+		}
+	}
+	return schema.PrimaryKey(pkeys...), nil
+}
+
+// check checks that the columns of the struct are in the table with the same types.
+func (m *structMapping) check(tdef *tableDef) error {
+	for _, f := range m.fields {
+		i := slices.Index(tdef.Cols, f.col)
+		if i < 0 {
+			return fmt.Errorf("column %s not found in table %s", f.col, tdef.Name)
+		}
+		if tdef.Types[i] != f.typ {
+			return fmt.Errorf("column %s of table %s: expected %s got %s", f.col, tdef.Name, tdef.Types[i], f.typ)
+		}
+	}
+	return nil
+}
+
+// record returns the values of the fields of the struct, the primary key ones only if pk is true.
+func (m *structMapping) record(rv reflect.Value, pk bool) AnonymousRecord {
+	ar := make(AnonymousRecord, len(m.fields))
+	for _, f := range m.fields {
+		if !pk || f.pk {
+			ar[f.col] = fieldValue(rv.FieldByIndex(f.index), f.typ)
+		}
+	}
+	return ar
+}
+
+// load sets the fields of the struct from the values of the record.
+func (m *structMapping) load(rv reflect.Value, ar AnonymousRecord) error {
+	for _, f := range m.fields {
+		if err := setField(rv.FieldByIndex(f.index), ar[f.col]); err != nil {
+			return fmt.Errorf("column %s: %w", f.col, err)
+		}
+	}
+	return nil
+}
+
+func fieldValue(fv reflect.Value, typ Type) Value {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			return Null(typ)
+		}
+		fv = fv.Elem()
+	}
+	switch typ {
+	case TypeInt64:
+		return Int64(fv.Int())
+	case TypeBlob:
+		return Blob(fv.Bytes())
+	case TypeBool:
+		return Bool(fv.Bool())
+	case TypeFloat64:
+		return Float64(fv.Float())
+	case TypeString:
+		return String(fv.String())
+	case TypeTimestamp:
+		// the zero time is out of the range of the timestamps.
+		if t := fv.Interface().(time.Time); !t.IsZero() {
+			return Timestamp(t)
+		}
+		return Null(typ)
+	case TypeUUID:
+		var u [16]byte
+		reflect.Copy(reflect.ValueOf(&u).Elem(), fv)
+		return UUID(u)
+	default:
+		panic(fmt.Sprintf("unknown type %d", typ))
+	}
+}
+
+// setField sets the field to the value, null sets it to its zero value.
+func setField(fv reflect.Value, v Value) error {
+	if v.IsNull() {
+		fv.SetZero()
+		return nil
+	}
+	if fv.Kind() == reflect.Pointer {
+		fv.Set(reflect.New(fv.Type().Elem()))
+		fv = fv.Elem()
+	}
+	switch v.Type {
+	case TypeInt64:
+		if fv.OverflowInt(v.I64) {
+			return fmt.Errorf("%d overflows %s", v.I64, fv.Type())
+		}
+		fv.SetInt(v.I64)
+	case TypeBlob:
+		fv.SetBytes(v.Blob)
+	case TypeBool:
+		fv.SetBool(v.Bool)
+	case TypeFloat64:
+		fv.SetFloat(v.F64)
+	case TypeString:
+		fv.SetString(v.Str)
+	case TypeTimestamp:
+		fv.Set(reflect.ValueOf(v.Time))
+	case TypeUUID:
+		reflect.Copy(fv, reflect.ValueOf(v.UUID))
+	default:
+		return fmt.Errorf("unknown type %d", v.Type)
+	}
+	return nil
+}
+
+// mappedTableDef returns the definition of the table, checking that it matches the mapping.
+func (tx *Tx) mappedTableDef(table string, m *structMapping) (*tableDef, error) {
+	tdef, err := tx.mustGetTableDef(table)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.check(tdef); err != nil {
+		return nil, err
+	}
+	return tdef, nil
+}
+
+// Put inserts or overwrites the record of the struct v, or of the struct v points to, see SchemaOf.
+// The columns of the table that are not in the struct take their default.
+func (tx *Tx) Put(v any) error {
+	m, rv, err := mappingOfValue(v)
+	if err != nil {
+		return err
+	}
+	return tx.put(m.table, m, rv)
+}
+
+func (tx *Tx) put(table string, m *structMapping, rv reflect.Value) error {
+	tdef, err := tx.mappedTableDef(table, m)
+	if err != nil {
+		return err
+	}
+	_, err = tx.insertRecord(*m.record(rv, false).IntoTableRecord(tdef), Upsert)
+	return err
+}
+
+// Load looks up the record with the primary key of the struct v points to and sets the fields of the struct
+// from it, see SchemaOf. It returns false and leaves the struct untouched if the record does not exist.
+func (tx *Tx) Load(v any) (bool, error) {
+	if reflect.ValueOf(v).Kind() != reflect.Pointer {
+		return false, fmt.Errorf("expected a pointer to a struct got %T", v)
+	}
+	m, rv, err := mappingOfValue(v)
+	if err != nil {
+		return false, err
+	}
+	return tx.load(m.table, m, rv, m.record(rv, true))
+}
+
+// load looks up the record with the primary key and sets the fields of the struct from it.
+func (tx *Tx) load(table string, m *structMapping, rv reflect.Value, key AnonymousRecord) (bool, error) {
+	tdef, err := tx.mappedTableDef(table, m)
+	if err != nil {
+		return false, err
+	}
+	rec := key.intoBound(tdef)
+	if ok, err := tx.getRecord(*rec); err != nil || !ok {
+		return false, err
+	}
+	ar := make(AnonymousRecord, len(rec.Vals))
+	ar.fill(rec)
+	return true, m.load(rv, ar)
+}
+
+// ScanInto sets the slice dst points to to the records of the table of its element type, in the primary key order.
+// The elements are structs or pointers to structs.
+func (tx *Tx) ScanInto(dst any) error {
+	slice := reflect.ValueOf(dst)
+	if slice.Kind() != reflect.Pointer || slice.IsNil() || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("expected a pointer to a slice got %T", dst)
+	}
+	slice = slice.Elem()
+	elem := slice.Type().Elem()
+	structType := elem
+	if elem.Kind() == reflect.Pointer {
+		structType = elem.Elem()
+	}
+	m, err := mappingOf(structType)
+	if err != nil {
+		return err
+	}
+	tdef, err := tx.mappedTableDef(m.table, m)
+	if err != nil {
+		return err
+	}
+	sc, err := tx.scanTable(tdef)
+	if err != nil {
+		return err
+	}
+	records := reflect.MakeSlice(slice.Type(), 0, 0)
+	for row, err := range sc.All() {
+		if err != nil {
+			return err
+		}
+		rv := reflect.New(structType)
+		if err := m.load(rv.Elem(), row.Record()); err != nil {
+			return err
+		}
+		if elem.Kind() != reflect.Pointer {
+			rv = rv.Elem()
+		}
+		records = reflect.Append(records, rv)
+	}
+	slice.Set(records)
+	return nil
+}
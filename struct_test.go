@@ -0,0 +1,156 @@
+package deadsimpledb
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type structTestBase struct {
+	Created time.Time `dsdb:"created"`
+}
+
+type structTestUser struct {
+	structTestBase
+	Org      int32    `dsdb:"org,pk"`
+	ID       int64    `dsdb:"id,pk"`
+	Name     string   `dsdb:"name"`
+	Email    *string  `dsdb:"email"`
+	Score    float64  `dsdb:"score"`
+	Admin    bool     `dsdb:"admin"`
+	Avatar   []byte   `dsdb:"avatar"`
+	Token    [16]byte `dsdb:"token"`
+	Nickname string
+	Cache    []int `dsdb:"-"`
+	internal int
+}
+
+func (structTestUser) TableName() string {
+	return "users"
+}
+
+func TestSchemaOf(t *testing.T) {
+	schema, err := SchemaOf(&structTestUser{})
+	require.NoError(t, err)
+	tdef, err := schema.tableDef()
+	require.NoError(t, err)
+	require.Equal(t, "users", tdef.Name)
+	require.Equal(t, []string{"org", "id", "created", "name", "email", "score", "admin", "avatar", "token", "Nickname"}, tdef.Cols)
+	require.Equal(t, []Type{TypeInt64, TypeInt64, TypeTimestamp, TypeString, TypeString, TypeFloat64, TypeBool, TypeBlob, TypeUUID, TypeString}, tdef.Types)
+	require.Equal(t, 2, tdef.Pkeys)
+
+	type unsupported struct {
+		ID uint64 `dsdb:"id,pk"`
+	}
+	_, err = SchemaOf(unsupported{})
+	require.Error(t, err)
+	type unknownOption struct {
+		ID int64 `dsdb:"id,primary"`
+	}
+	_, err = SchemaOf(unknownOption{})
+	require.Error(t, err)
+	_, err = SchemaOf(1)
+	require.Error(t, err)
+}
+
+func TestDBStruct(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "struct.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	schema, err := SchemaOf(structTestUser{})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateTable(schema))
+
+	email := "bob@example.com"
+	users := []structTestUser{
+		{Org: 1, ID: 2, Name: "bob", Email: &email, Score: 1.5, Admin: true, Avatar: []byte{1}, Token: [16]byte{15: 1}},
+		{Org: 1, ID: 1, Name: "alice", Nickname: "al"},
+		{Org: 0, ID: 3, Name: "carol", Cache: []int{1}},
+	}
+	users[0].Created = time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	for _, u := range users {
+		require.NoError(t, db.Put(&u))
+	}
+
+	t.Run("load", func(t *testing.T) {
+		u := structTestUser{Org: 1, ID: 2}
+		ok, err := db.Load(&u)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, users[0], u)
+
+		u = structTestUser{Org: 1, ID: 1, Email: &email, Cache: []int{2}}
+		ok, err = db.Load(&u)
+		require.NoError(t, err)
+		require.True(t, ok)
+		// null reads as nil or the zero value, the skipped fields are left as they are.
+		require.Nil(t, u.Email)
+		require.True(t, u.Created.IsZero())
+		require.Equal(t, []int{2}, u.Cache)
+		require.Equal(t, "al", u.Nickname)
+
+		ok, err = db.Load(&structTestUser{Org: 2, ID: 2})
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, err = db.Load(structTestUser{})
+		require.Error(t, err)
+	})
+
+	t.Run("scan_into", func(t *testing.T) {
+		var got []structTestUser
+		require.NoError(t, db.ScanInto(&got))
+		require.Len(t, got, 3)
+		require.Equal(t, []string{"carol", "alice", "bob"}, []string{got[0].Name, got[1].Name, got[2].Name})
+		require.Equal(t, users[0], got[2])
+
+		var ptrs []*structTestUser
+		require.NoError(t, db.ScanInto(&ptrs))
+		require.Len(t, ptrs, 3)
+		require.Equal(t, "carol", ptrs[0].Name)
+		require.Error(t, db.ScanInto(got))
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		u := users[0]
+		u.Email = nil
+		require.NoError(t, db.Put(u))
+		got := structTestUser{Org: 1, ID: 2}
+		_, err := db.Load(&got)
+		require.NoError(t, err)
+		require.Nil(t, got.Email)
+	})
+
+	t.Run("blob_key", func(t *testing.T) {
+		type files struct {
+			Path []byte `dsdb:"path,pk"`
+			Size int64  `dsdb:"size"`
+		}
+		schema, err := SchemaOf(files{})
+		require.NoError(t, err)
+		require.NoError(t, db.CreateTable(schema))
+
+		// the key shares its backing array with the rest of the buffer, which must be left as is.
+		buf := []byte("abcXYZ")
+		require.NoError(t, db.Put(files{Path: buf[:3], Size: 1}))
+		require.Equal(t, []byte("abcXYZ"), buf)
+		got := files{Path: buf[:3]}
+		ok, err := db.Load(&got)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, int64(1), got.Size)
+		require.Equal(t, []byte("abcXYZ"), buf)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		type users struct {
+			ID string `dsdb:"id,pk"`
+		}
+		require.Error(t, db.Put(users{ID: "1"}))
+		type posts struct {
+			ID int64 `dsdb:"id,pk"`
+		}
+		require.Error(t, db.Put(posts{ID: 1}))
+	})
+}
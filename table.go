@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"slices"
+	"time"
+	"unicode/utf8"
 )
 
 type tableDef struct {
@@ -17,6 +21,27 @@ type tableDef struct {
 	Pkeys int
 	// auto-assigned B-tree key Prefix for the table
 	Prefix uint32
+	// Indexes are the secondary indexes of the table, each is a list of columns.
+	Indexes [][]string
+	// auto-assigned B-tree key prefixes of the indexes, in the order of Indexes
+	IndexPrefixes []uint32
+	// Unique tells which indexes are unique, in the order of Indexes. Missing entries are false.
+	// Two records can not have the same values in a unique index unless one of them is null.
+	Unique []bool
+	// Version is the schema version, incremented by every AlterTable. The records are stored with
+	// the version they are written with and are read with its columns, see upgradeValues.
+	Version uint32
+	// Schemas are the non-key columns of the previous versions, Schemas[v] are the ones of version v.
+	Schemas []tableSchema
+	// Defaults are the values of the columns that have one. They are the values of the records written before
+	// the column is added and of the records inserted without it.
+	Defaults map[string]Value
+}
+
+// tableSchema is the layout of the non-key columns of a schema version.
+type tableSchema struct {
+	Cols  []string
+	Types []Type
 }
 
 func (tdef tableDef) Serialize(b *bytes.Buffer) error {
@@ -33,28 +58,108 @@ func (tdef tableDef) Validate() error {
 	if tdef.Pkeys < 1 || tdef.Pkeys > len(tdef.Cols) {
 		return fmt.Errorf("invalid primary key")
 	}
+	for i, typ := range tdef.Types {
+		if typ <= errorType || typ > TypeUUID {
+			return fmt.Errorf("column %s: unknown type %d", tdef.Cols[i], typ)
+		}
+	}
+	if int(tdef.Version) != len(tdef.Schemas) {
+		return fmt.Errorf("schema version %d does not match %d previous schemas", tdef.Version, len(tdef.Schemas))
+	}
+	for col, v := range tdef.Defaults {
+		idx := slices.Index(tdef.Cols, col)
+		if idx < tdef.Pkeys {
+			return fmt.Errorf("default for %s: not a non-key column", col)
+		}
+		if v.Type != tdef.Types[idx] {
+			return fmt.Errorf("default for %s: expected %s got %s", col, tdef.Types[idx], v.Type)
+		}
+	}
+	if len(tdef.Unique) > len(tdef.Indexes) {
+		return fmt.Errorf("more unique flags than indexes")
+	}
+	for i, index := range tdef.Indexes {
+		if len(index) == 0 {
+			return fmt.Errorf("index %d has no column", i)
+		}
+		for j, col := range index {
+			if !slices.Contains(tdef.Cols, col) {
+				return fmt.Errorf("index %d: column %s not found", i, col)
+			}
+			if slices.Contains(index[:j], col) {
+				return fmt.Errorf("index %d: duplicate column %s", i, col)
+			}
+		}
+		for _, other := range tdef.Indexes[:i] {
+			if slices.Equal(index, other) {
+				return fmt.Errorf("duplicate index %v", index)
+			}
+		}
+	}
 	return nil
 }
 
-type AnonymousRecord map[string]value
+// isUnique returns true if the ith index is unique.
+func (tdef tableDef) isUnique(i int) bool {
+	return i < len(tdef.Unique) && tdef.Unique[i]
+}
+
+// keptSince returns true if the column is in every schema version after the given one,
+// a column that is dropped and then added again is a new column.
+func (tdef tableDef) keptSince(col string, version uint32) bool {
+	for _, schema := range tdef.Schemas[version+1:] {
+		if !slices.Contains(schema.Cols, col) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexCols returns the positions of the columns of the ith index.
+func (tdef tableDef) indexCols(i int) []int {
+	cols := make([]int, len(tdef.Indexes[i]))
+	for j, col := range tdef.Indexes[i] {
+		cols[j] = slices.Index(tdef.Cols, col)
+	}
+	return cols
+}
+
+// AnonymousRecord holds the values of a record by column, the missing columns are null.
+type AnonymousRecord map[string]Value
 
 // IntoRecord converts the anonymous record into a table record.
 // Values that do not match the table definition are ignored.
 func (ar AnonymousRecord) IntoTableRecord(tdef *tableDef) *tableRecord {
-	r := newTableRecord(tdef)
+	r := ar.intoBound(tdef)
+	for col, v := range tdef.Defaults {
+		if _, ok := ar[col]; !ok {
+			r.SetVal(col, v)
+		}
+	}
+	return r
+}
 
+// intoBound converts the anonymous record into a table record without the defaults of the table,
+// so that a scan bound only holds the columns it is given.
+func (ar AnonymousRecord) intoBound(tdef *tableDef) *tableRecord {
+	r := newTableRecord(tdef)
 	for _, col := range tdef.Cols {
-		v, ok := ar[col]
-		if !ok {
-			continue
+		if v, ok := ar[col]; ok {
+			r.SetVal(col, v)
 		}
-		r.SetVal(col, v)
 	}
 	return r
 }
 
+// fill sets the values of the record into the anonymous record, null values included.
+func (ar AnonymousRecord) fill(r *tableRecord) {
+	for i, col := range r.tdef.Cols {
+		ar[col] = r.Vals[i]
+	}
+}
+
 type tableRecord struct {
-	Vals  []value
+	Vals  []Value
 	tdef  *tableDef
 	valid bool
 }
@@ -64,61 +169,192 @@ type tableRecord struct {
 func newTableRecord(tdef *tableDef) *tableRecord {
 	assert(tdef != nil, "table definition is nil")
 	r := &tableRecord{
-		Vals: make([]value, len(tdef.Cols)),
+		Vals: make([]Value, len(tdef.Cols)),
 		tdef: tdef,
 	}
 	for i, typ := range tdef.Types {
-		r.Vals[i] = newNullValue(typ)
+		r.Vals[i] = Null(typ)
 	}
 	return r
 }
 
+// serializePK serializes the table prefix followed by the primary key columns, see serializeKey.
+// The prefix is big-endian so that the records of a table are contiguous and ordered by their primary key.
 func (r tableRecord) serializePK(w io.Writer) error {
 	if err := r.ValidatePK(); err != nil {
 		return err
 	}
 	var buf [4]byte
-	binary.LittleEndian.PutUint32(buf[:], r.tdef.Prefix)
+	binary.BigEndian.PutUint32(buf[:], r.tdef.Prefix)
 	if _, err := w.Write(buf[:]); err != nil {
 		return err
 	}
-	if err := serializeValues(w, r.Vals[:r.tdef.Pkeys]); err != nil {
-		return nil
+	if err := serializeKey(w, r.Vals[:r.tdef.Pkeys]); err != nil {
+		return err
 	}
 	return nil
 }
 
+// serializePKPrefix serializes the table prefix followed by the first n primary key columns.
+// As the encoding of the columns is prefix-free, the key of every record whose first n primary key
+// columns are equal to the ones of r starts with it.
+func (r tableRecord) serializePKPrefix(w io.Writer, n int) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	assert(n <= r.tdef.Pkeys, "%d primary key columns out of %d", n, r.tdef.Pkeys)
+	for i := 0; i < n; i++ {
+		if r.Vals[i].IsNull() {
+			return fmt.Errorf("primary key column %d is null", i)
+		}
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], r.tdef.Prefix)
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	return serializeKey(w, r.Vals[:n])
+}
+
 func (r *tableRecord) deserializePK(reader io.Reader) error {
 	var buf [4]byte
-	if _, err := reader.Read(buf[:]); err != nil {
+	if _, err := io.ReadFull(reader, buf[:]); err != nil {
 		return err
 	}
 	vals := r.Vals[:r.tdef.Pkeys]
-	if err := deserializeValues(reader, vals); err != nil {
+	if err := deserializeKey(reader, vals); err != nil {
+		return err
+	}
+	return nil
+}
+
+// serializeIndexKey serializes the key of the record in the ith index: the index prefix,
+// the indexed columns, see serializeNullableKey, and then the primary key columns.
+// The primary key makes the key unique and points to the record.
+func (r tableRecord) serializeIndexKey(w io.Writer, i int) error {
+	if err := r.ValidatePK(); err != nil {
+		return err
+	}
+	if err := r.serializeIndexBound(w, i); err != nil {
+		return err
+	}
+	return serializeKey(w, r.Vals[:r.tdef.Pkeys])
+}
+
+// serializeIndexBound serializes the index prefix and the indexed columns, without the primary key.
+// Every key of the index whose indexed columns are equal to the record starts with it.
+func (r tableRecord) serializeIndexBound(w io.Writer, i int) error {
+	if err := r.validate(); err != nil {
 		return err
 	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], r.tdef.IndexPrefixes[i])
+	if _, err := w.Write(buf[:]); err != nil {
+		return err
+	}
+	for _, col := range r.tdef.indexCols(i) {
+		if err := serializeNullableKey(w, r.Vals[col]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// deserializeIndexKey reads the indexed and the primary key columns from a key of the ith index.
+func (r *tableRecord) deserializeIndexKey(reader io.Reader, i int) error {
+	var buf [4]byte
+	if _, err := io.ReadFull(reader, buf[:]); err != nil {
+		return err
+	}
+	for _, col := range r.tdef.indexCols(i) {
+		if err := deserializeNullableKey(reader, &r.Vals[col]); err != nil {
+			return err
+		}
+	}
+	return deserializeKey(reader, r.Vals[:r.tdef.Pkeys])
+}
+
+// serializeValues serializes the schema version of the table followed by the non-key columns.
+// | schema version | values, see serializeValues |
+// | 4B             | ...                         |
 func (r tableRecord) serializeValues(w io.Writer) error {
 	if err := r.validate(); err != nil {
 		return err
 	}
+	if err := binary.Write(w, binary.LittleEndian, r.tdef.Version); err != nil {
+		return err
+	}
 	return serializeValues(w, r.Vals[r.tdef.Pkeys:])
 }
 
+// deserializeValues reads the non-key columns, upgrading them if they are written with a previous schema version.
 func (r *tableRecord) deserializeValues(reader io.Reader) error {
-	vals := r.Vals[r.tdef.Pkeys:]
-	if err := deserializeValues(reader, vals); err != nil {
+	version, err := readSchemaVersion(reader)
+	if err != nil {
 		return err
 	}
-	if len(vals) != len(r.tdef.Cols)-r.tdef.Pkeys {
-		r.valid = false
-		return fmt.Errorf("expected %d values, received %d", len(r.tdef.Cols)-r.tdef.Pkeys, len(vals))
+	if version == r.tdef.Version {
+		return deserializeValues(reader, r.Vals[r.tdef.Pkeys:])
+	}
+	if version > r.tdef.Version || int(version) >= len(r.tdef.Schemas) {
+		return fmt.Errorf("%w: unknown schema version %d", ErrCorrupt, version)
+	}
+	schema := r.tdef.Schemas[version]
+	old := make([]Value, len(schema.Types))
+	for i, typ := range schema.Types {
+		old[i] = Null(typ)
 	}
+	if err := deserializeValues(reader, old); err != nil {
+		return err
+	}
+	r.upgradeValues(version, old)
 	return nil
 }
 
+func readSchemaVersion(reader io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(reader, buf[:]); err != nil {
+		return 0, fmt.Errorf("%w: reading schema version: %v", ErrCorrupt, err)
+	}
+	return binary.LittleEndian.Uint32(buf[:]), nil
+}
+
+// upgradeValues sets the non-key columns from the values of a record written with a previous schema version.
+// A column keeps its value if it is in every version since, otherwise it takes its default, if any.
+func (r *tableRecord) upgradeValues(version uint32, old []Value) {
+	schema := r.tdef.Schemas[version]
+	for i := r.tdef.Pkeys; i < len(r.tdef.Cols); i++ {
+		col := r.tdef.Cols[i]
+		if j := slices.Index(schema.Cols, col); j >= 0 && r.tdef.keptSince(col, version) {
+			r.Vals[i] = old[j]
+		} else if def, ok := r.tdef.Defaults[col]; ok {
+			r.Vals[i] = def
+		} else {
+			r.Vals[i] = Null(r.tdef.Types[i])
+		}
+	}
+}
+
+// indexSet returns true if the columns of the ith index are set.
+func (r tableRecord) indexSet(i int) bool {
+	if !r.isValid() {
+		return false
+	}
+	for _, col := range r.tdef.indexCols(i) {
+		if r.Vals[col].IsNull() {
+			return false
+		}
+	}
+	return true
+}
+
+// clonePK returns a record of the same table holding only the primary key of the record.
+func (r tableRecord) clonePK() *tableRecord {
+	clone := newTableRecord(r.tdef)
+	copy(clone.Vals[:r.tdef.Pkeys], r.Vals[:r.tdef.Pkeys])
+	return clone
+}
+
 // ValidatePK checks if primary key columns are not null
 // It fails if the record is not valid.
 func (r *tableRecord) ValidatePK() error {
@@ -126,7 +362,7 @@ func (r *tableRecord) ValidatePK() error {
 		return err
 	}
 	for i := 0; i < r.tdef.Pkeys; i++ {
-		if r.Vals[i].isNull() {
+		if r.Vals[i].IsNull() {
 			return fmt.Errorf("primary key column %d is null", i)
 		}
 	}
@@ -140,6 +376,7 @@ func (r *tableRecord) ValidatePK() error {
 //   - the column names match the table definition (in order)
 //   - the value types match the table definition (in order)
 //   - the primary key columns are not null
+//   - the strings are valid UTF-8 and the timestamps are within the range of Timestamp
 func (r tableRecord) validate() error {
 	if r.valid {
 		return nil
@@ -152,8 +389,14 @@ func (r tableRecord) validate() error {
 	}
 
 	for i := 0; i < len(r.tdef.Cols); i++ {
-		if !r.Vals[i].isNull() && r.Vals[i].Type != r.tdef.Types[i] {
-			return fmt.Errorf("expected %s for %s got %d", r.tdef.Types[i], r.tdef.Cols[i], r.Vals[i].Type)
+		if !r.Vals[i].IsNull() && r.Vals[i].Type != r.tdef.Types[i] {
+			return fmt.Errorf("expected %s for %s got %s", r.tdef.Types[i], r.tdef.Cols[i], r.Vals[i].Type)
+		}
+		if r.Vals[i].Type == TypeString && !utf8.ValidString(r.Vals[i].Str) {
+			return fmt.Errorf("invalid UTF-8 string for %s", r.tdef.Cols[i])
+		}
+		if r.Vals[i].Type == TypeTimestamp && !r.Vals[i].IsNull() && !timestampInRange(r.Vals[i].Time) {
+			return fmt.Errorf("timestamp out of range for %s: %s", r.tdef.Cols[i], r.Vals[i].Time)
 		}
 	}
 
@@ -165,7 +408,7 @@ func (r tableRecord) isValid() bool {
 	return r.validate() == nil
 }
 
-func (r *tableRecord) SetVal(col string, val value) *tableRecord {
+func (r *tableRecord) SetVal(col string, val Value) *tableRecord {
 	if !r.isValid() {
 		return r
 	}
@@ -182,14 +425,34 @@ func (r *tableRecord) SetVal(col string, val value) *tableRecord {
 }
 
 func (rec *tableRecord) SetBlob(key string, val []byte) *tableRecord {
-	return rec.SetVal(key, newBlob(val))
+	return rec.SetVal(key, Blob(val))
 }
 
 func (rec *tableRecord) SetInt64(key string, val int64) *tableRecord {
-	return rec.SetVal(key, newInt64(val))
+	return rec.SetVal(key, Int64(val))
 }
 
-func (rec *tableRecord) Get(col string) *value {
+func (rec *tableRecord) SetBool(key string, val bool) *tableRecord {
+	return rec.SetVal(key, Bool(val))
+}
+
+func (rec *tableRecord) SetFloat64(key string, val float64) *tableRecord {
+	return rec.SetVal(key, Float64(val))
+}
+
+func (rec *tableRecord) SetString(key string, val string) *tableRecord {
+	return rec.SetVal(key, String(val))
+}
+
+func (rec *tableRecord) SetTimestamp(key string, val time.Time) *tableRecord {
+	return rec.SetVal(key, Timestamp(val))
+}
+
+func (rec *tableRecord) SetUUID(key string, val [16]byte) *tableRecord {
+	return rec.SetVal(key, UUID(val))
+}
+
+func (rec *tableRecord) Get(col string) *Value {
 	idx := slices.Index(rec.tdef.Cols, col)
 	if idx == -1 {
 		return nil
@@ -197,112 +460,502 @@ func (rec *tableRecord) Get(col string) *value {
 	return &rec.Vals[idx]
 }
 
+// Row is a record read from a table.
+// The typed getters return the zero value of their type if the value is null, the column does not exist
+// or is of another type. Use Get to tell these apart.
+type Row struct {
+	rec *tableRecord
+}
+
+// Columns returns the columns of the row, the primary key columns first.
+func (r *Row) Columns() []string {
+	return slices.Clone(r.rec.tdef.Cols)
+}
+
+// Get returns the value of the column. If the column does not exist it returns the zero Value,
+// which is null and has no type.
+func (r *Row) Get(col string) Value {
+	v := r.rec.Get(col)
+	if v == nil {
+		return Value{}
+	}
+	return *v
+}
+
+// IsNull returns true if the value of the column is null or the column does not exist.
+func (r *Row) IsNull(col string) bool {
+	return r.Get(col).IsNull()
+}
+
+// typed returns the value of the column if it is of the given type, the zero Value otherwise.
+func (r *Row) typed(col string, typ Type) Value {
+	if v := r.Get(col); v.Type == typ {
+		return v
+	}
+	return Value{}
+}
+
+func (r *Row) Int64(col string) int64 {
+	v := r.typed(col, TypeInt64)
+	return v.I64
+}
+
+func (r *Row) Blob(col string) []byte {
+	v := r.typed(col, TypeBlob)
+	return v.Blob
+}
+
+func (r *Row) Bool(col string) bool {
+	v := r.typed(col, TypeBool)
+	return v.Bool
+}
+
+func (r *Row) Float64(col string) float64 {
+	v := r.typed(col, TypeFloat64)
+	return v.F64
+}
+
+func (r *Row) String(col string) string {
+	v := r.typed(col, TypeString)
+	return v.Str
+}
+
+func (r *Row) Timestamp(col string) time.Time {
+	v := r.typed(col, TypeTimestamp)
+	return v.Time
+}
+
+func (r *Row) UUID(col string) [16]byte {
+	v := r.typed(col, TypeUUID)
+	return v.UUID
+}
+
+// Record returns the values of the row by column.
+func (r *Row) Record() AnonymousRecord {
+	ar := make(AnonymousRecord, len(r.rec.Vals))
+	ar.fill(r.rec)
+	return ar
+}
+
+// Type is the type of a column.
 type Type uint32
 
 func (t Type) String() string {
 	switch t {
-	case typeBlob:
+	case TypeBlob:
 		return "blob"
-	case typeInt64:
+	case TypeInt64:
 		return "int"
+	case TypeBool:
+		return "bool"
+	case TypeFloat64:
+		return "float"
+	case TypeString:
+		return "string"
+	case TypeTimestamp:
+		return "timestamp"
+	case TypeUUID:
+		return "uuid"
 	default:
 		return "unknown type"
 	}
 }
 
+// The column types, errorType is the type of no column.
 const (
-	errorType Type = 0
-	typeBlob  Type = 1
-	typeInt64 Type = 2
+	errorType     Type = 0
+	TypeBlob      Type = 1
+	TypeInt64     Type = 2
+	TypeBool      Type = 3
+	TypeFloat64   Type = 4
+	TypeString    Type = 5
+	TypeTimestamp Type = 6
+	TypeUUID      Type = 7
 )
 
-type value struct {
+// Value is a column value, only the field of its type is used. Set is false for null.
+// Use the constructor of its type to build one, e.g. Int64 or String.
+type Value struct {
 	Type Type
 	I64  int64
 	Blob []byte
+	Bool bool
+	F64  float64
+	Str  string
+	// Time is in UTC with a nanosecond precision.
+	Time time.Time
+	UUID [16]byte
 	Set  bool
 }
 
-func (v value) isNull() bool {
+// IsNull returns true if the value is null.
+func (v Value) IsNull() bool {
 	return !v.Set
 }
 
-func newInt64(i int64) value {
-	return value{Type: typeInt64, I64: i, Set: true}
+func (v Value) String() string {
+	if v.IsNull() {
+		return "null"
+	}
+	switch v.Type {
+	case TypeInt64:
+		return fmt.Sprintf("%d", v.I64)
+	case TypeBlob:
+		return fmt.Sprintf("%q", v.Blob)
+	case TypeBool:
+		return fmt.Sprintf("%t", v.Bool)
+	case TypeFloat64:
+		return fmt.Sprintf("%g", v.F64)
+	case TypeString:
+		return fmt.Sprintf("%q", v.Str)
+	case TypeTimestamp:
+		return v.Time.Format(time.RFC3339Nano)
+	case TypeUUID:
+		u := v.UUID
+		return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	default:
+		return fmt.Sprintf("value of unknown type %d", v.Type)
+	}
 }
 
-func newBlob(b []byte) value {
-	return value{Type: typeBlob, Blob: b, Set: true}
+// Int64 returns an int64 value.
+func Int64(i int64) Value {
+	return Value{Type: TypeInt64, I64: i, Set: true}
 }
 
-func newNullValue(typ Type) value {
-	return value{Type: typ, Set: false}
+// Blob returns a blob value, the value refers to b.
+func Blob(b []byte) Value {
+	return Value{Type: TypeBlob, Blob: b, Set: true}
 }
 
-// serializeValues serializes each value in the slice to the writer.
+// Bool returns a bool value.
+func Bool(b bool) Value {
+	return Value{Type: TypeBool, Bool: b, Set: true}
+}
+
+// Float64 returns a float64 value.
+func Float64(f float64) Value {
+	return Value{Type: TypeFloat64, F64: f, Set: true}
+}
+
+// String returns a string value, records holding a string that is not valid UTF-8 are invalid.
+func String(s string) Value {
+	return Value{Type: TypeString, Str: s, Set: true}
+}
+
+// The range of the timestamps, whose nanoseconds since the epoch fit in an int64: from 1677 to 2262.
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+func timestampInRange(t time.Time) bool {
+	return !t.Before(minTimestamp) && !t.After(maxTimestamp)
+}
+
+// Timestamp returns a timestamp value of the time in UTC, only its nanoseconds since the epoch are kept.
+// Records holding a time outside of the range of the nanoseconds, from 1677 to 2262, are invalid.
+func Timestamp(t time.Time) Value {
+	if !timestampInRange(t) {
+		// t.UnixNano is undefined, the time is kept as is for the record to be rejected.
+		return Value{Type: TypeTimestamp, Time: t.UTC(), Set: true}
+	}
+	return Value{Type: TypeTimestamp, Time: time.Unix(0, t.UnixNano()).UTC(), Set: true}
+}
+
+// UUID returns a UUID value.
+func UUID(u [16]byte) Value {
+	return Value{Type: TypeUUID, UUID: u, Set: true}
+}
+
+// Null returns the null value of the type.
+func Null(typ Type) Value {
+	return Value{Type: typ, Set: false}
+}
+
+// orderedFloat64 maps the float to an integer with the same order: the sign bit is flipped for
+// positive numbers and every bit for negative ones.
+func orderedFloat64(f float64) uint64 {
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		return ^u
+	}
+	return u | 1<<63
+}
+
+func unorderedFloat64(u uint64) float64 {
+	if u&(1<<63) != 0 {
+		return math.Float64frombits(u &^ (1 << 63))
+	}
+	return math.Float64frombits(^u)
+}
+
+// serializeKey serializes each value in the slice to the writer so that
+// comparing the serialized keys with bytes.Compare orders them as their values.
 // The following encoding is used for:
-// - int64: Fixed Bias Encoding. Null values are encoed as 8 bytes of \x00.
-// - blob: null-terminated byte array. Null values are encoed as \x00.
-func serializeValues(w io.Writer, values []value) error {
+// - int64: Fixed Bias Encoding, big-endian.
+// - blob, string: null-terminated byte array, see escapeNull.
+// - bool: 1B, 0 or 1.
+// - float64: big-endian bits with the sign flipped, see orderedFloat64.
+// - timestamp: nanoseconds since the epoch as int64.
+// - uuid: the 16 bytes.
+//
+// The key columns are never null. A null value is encoded as the zero value of its type.
+func serializeKey(w io.Writer, values []Value) error {
 	for _, v := range values {
+		var err error
+		switch v.Type {
+		case TypeInt64:
+			err = binary.Write(w, binary.BigEndian, uint64(v.I64)+1<<63)
+		case TypeBlob:
+			err = writeNullTerminated(w, v.Blob)
+		case TypeString:
+			err = writeNullTerminated(w, []byte(v.Str))
+		case TypeBool:
+			var b byte
+			if v.Bool {
+				b = 1
+			}
+			_, err = w.Write([]byte{b})
+		case TypeFloat64:
+			err = binary.Write(w, binary.BigEndian, orderedFloat64(v.F64))
+		case TypeTimestamp:
+			var ns int64
+			if !v.IsNull() {
+				ns = v.Time.UnixNano()
+			}
+			err = binary.Write(w, binary.BigEndian, uint64(ns)+1<<63)
+		case TypeUUID:
+			_, err = w.Write(v.UUID[:])
+		default:
+			return fmt.Errorf("encoding %v: unknown type %d", v, v.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("encoding %v: %w", v, err)
+		}
+	}
+	return nil
+}
+
+// deserializeKey reads the values written by serializeKey, every value is set as the key columns are never null.
+func deserializeKey(r io.Reader, values []Value) error {
+	for i, v := range values {
+		var err error
 		switch v.Type {
-		case typeInt64:
+		case TypeInt64:
 			var u uint64
-			if !v.isNull() {
-				u = uint64(v.I64) + 1<<63
+			err = binary.Read(r, binary.BigEndian, &u)
+			values[i] = Int64(int64(u - 1<<63))
+		case TypeBlob, TypeString:
+			var blob []byte
+			if blob, err = readNullTerminatedBlob(r); err != nil {
+				break
 			}
-			if err := binary.Write(w, binary.LittleEndian, u); err != nil {
-				return fmt.Errorf("encoding %v: %w", v, err)
+			if blob, err = unescapeNull(blob); err != nil {
+				break
 			}
-		case typeBlob:
-			if !v.isNull() {
-				if _, err := w.Write(escapeNull(v.Blob)); err != nil {
-					return fmt.Errorf("encoding %v: %w", v, err)
+			if v.Type == TypeString {
+				if !utf8.Valid(blob) {
+					return fmt.Errorf("%w: deserializing %dth key value: invalid UTF-8", ErrCorrupt, i)
 				}
+				values[i] = String(string(blob))
+			} else {
+				values[i] = Blob(append([]byte{}, blob...))
 			}
-			if _, err := w.Write([]byte{0}); err != nil {
-				return fmt.Errorf("encoding %v: %w", v, err)
+		case TypeBool:
+			var b [1]byte
+			_, err = io.ReadFull(r, b[:])
+			values[i] = Bool(b[0] != 0)
+		case TypeFloat64:
+			var u uint64
+			err = binary.Read(r, binary.BigEndian, &u)
+			values[i] = Float64(unorderedFloat64(u))
+		case TypeTimestamp:
+			var u uint64
+			err = binary.Read(r, binary.BigEndian, &u)
+			values[i] = Timestamp(time.Unix(0, int64(u-1<<63)))
+		case TypeUUID:
+			var u [16]byte
+			_, err = io.ReadFull(r, u[:])
+			values[i] = UUID(u)
+		default:
+			return fmt.Errorf("%w: deserializing %dth key value: unknown type %d", ErrCorrupt, i, v.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("deserializing %dth key value: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// serializeNullableKey serializes the value like serializeKey, after a byte telling if it is null.
+// The null value is encoded as \x00 alone, so it is ordered before any other value.
+func serializeNullableKey(w io.Writer, v Value) error {
+	if v.IsNull() {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	if _, err := w.Write([]byte{1}); err != nil {
+		return err
+	}
+	return serializeKey(w, []Value{v})
+}
+
+func deserializeNullableKey(r io.Reader, v *Value) error {
+	var marker [1]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return err
+	}
+	switch marker[0] {
+	case 0:
+		*v = Null(v.Type)
+		return nil
+	case 1:
+		values := []Value{{Type: v.Type}}
+		if err := deserializeKey(r, values); err != nil {
+			return err
+		}
+		*v = values[0]
+		return nil
+	default:
+		return fmt.Errorf("%w: invalid null marker %d", ErrCorrupt, marker[0])
+	}
+}
+
+// serializeValues serializes each value in the slice to the writer.
+// Unlike serializeKey the encoding does not preserve the order of the values, but it keeps null apart
+// from every other value.
+// | null bitmap        | non-null values |
+// | (len(values)+7)/8B | ...             |
+// The ith bit of the bitmap is set if the ith value is null, the non-null values follow in order:
+// - int64: 8B little-endian.
+// - blob, string: 4B little-endian length followed by the bytes.
+// - bool: 1B, 0 or 1.
+// - float64: 8B little-endian bits.
+// - timestamp: nanoseconds since the epoch as 8B little-endian.
+// - uuid: the 16 bytes.
+func serializeValues(w io.Writer, values []Value) error {
+	bitmap := make([]byte, (len(values)+7)/8)
+	for i, v := range values {
+		if v.IsNull() {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	if _, err := w.Write(bitmap); err != nil {
+		return fmt.Errorf("encoding null bitmap: %w", err)
+	}
+	for _, v := range values {
+		if v.IsNull() {
+			continue
+		}
+		var err error
+		switch v.Type {
+		case TypeInt64:
+			err = binary.Write(w, binary.LittleEndian, v.I64)
+		case TypeBlob:
+			err = writeLengthPrefixed(w, v.Blob)
+		case TypeString:
+			err = writeLengthPrefixed(w, []byte(v.Str))
+		case TypeBool:
+			var b byte
+			if v.Bool {
+				b = 1
 			}
+			_, err = w.Write([]byte{b})
+		case TypeFloat64:
+			err = binary.Write(w, binary.LittleEndian, math.Float64bits(v.F64))
+		case TypeTimestamp:
+			err = binary.Write(w, binary.LittleEndian, v.Time.UnixNano())
+		case TypeUUID:
+			_, err = w.Write(v.UUID[:])
 		default:
-			panic("unknown type")
+			return fmt.Errorf("encoding %v: unknown type %d", v, v.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("encoding %v: %w", v, err)
 		}
 	}
 
 	return nil
 }
 
-func deserializeValues(r io.Reader, values []value) error {
-	for i, value := range values {
-		var isNull bool
-		switch value.Type {
-		case typeInt64:
-			v := uint64(0)
-			if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
-				return fmt.Errorf("deserializing %dth value: %w", i, err)
-			}
-			isNull = v == 0
-			if !isNull {
-				values[i].I64 = int64(v - 1<<63)
-			}
-		case typeBlob:
-			blob, err := readNullTerminatedBlob(r)
-			if err != nil {
-				return fmt.Errorf("deserializing %dth value: %w", i, err)
-			}
-			if len(blob) == 0 {
-				isNull = true
-			}
-			if !isNull {
-				values[i].Blob = unescapeNull(blob)
+// deserializeValues reads the values written by serializeValues.
+// It fails with ErrCorrupt if the data is truncated or invalid.
+func deserializeValues(r io.Reader, values []Value) error {
+	bitmap := make([]byte, (len(values)+7)/8)
+	if _, err := io.ReadFull(r, bitmap); err != nil {
+		return fmt.Errorf("%w: deserializing null bitmap: %v", ErrCorrupt, err)
+	}
+	for i, v := range values {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			values[i] = Null(v.Type)
+			continue
+		}
+		var err error
+		switch v.Type {
+		case TypeInt64:
+			var i64 int64
+			err = binary.Read(r, binary.LittleEndian, &i64)
+			values[i] = Int64(i64)
+		case TypeBlob:
+			var blob []byte
+			blob, err = readLengthPrefixed(r)
+			values[i] = Blob(blob)
+		case TypeString:
+			var str []byte
+			if str, err = readLengthPrefixed(r); err == nil && !utf8.Valid(str) {
+				err = errors.New("invalid UTF-8")
 			}
+			values[i] = String(string(str))
+		case TypeBool:
+			var b [1]byte
+			_, err = io.ReadFull(r, b[:])
+			values[i] = Bool(b[0] != 0)
+		case TypeFloat64:
+			var u uint64
+			err = binary.Read(r, binary.LittleEndian, &u)
+			values[i] = Float64(math.Float64frombits(u))
+		case TypeTimestamp:
+			var ns int64
+			err = binary.Read(r, binary.LittleEndian, &ns)
+			values[i] = Timestamp(time.Unix(0, ns))
+		case TypeUUID:
+			var u [16]byte
+			_, err = io.ReadFull(r, u[:])
+			values[i] = UUID(u)
 		default:
-			panic("unknown type")
+			return fmt.Errorf("%w: deserializing %dth value: unknown type %d", ErrCorrupt, i, v.Type)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: deserializing %dth value: %v", ErrCorrupt, i, err)
 		}
-		values[i].Set = !isNull
 	}
 	return nil
 }
 
+func writeLengthPrefixed(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+	if int64(n) > int64(MaxValueSize) {
+		return nil, fmt.Errorf("length %d out of bound", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func readNullTerminatedBlob(r io.Reader) ([]byte, error) {
 	b := make([]byte, 1)
 	var blob []byte
@@ -318,6 +971,16 @@ func readNullTerminatedBlob(r io.Reader) ([]byte, error) {
 	return blob, nil
 }
 
+// writeNullTerminated writes the escaped bytes followed by \x00, see escapeNull.
+// The terminator is written on its own as the escaped bytes can be b itself, which belongs to the caller.
+func writeNullTerminated(w io.Writer, b []byte) error {
+	if _, err := w.Write(escapeNull(b)); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{0})
+	return err
+}
+
 // escapeNull escapes \x00 with \x01\x01 and \x01 with \x01\x02
 // The returned slice is only copied on write.
 func escapeNull(b []byte) []byte {
@@ -338,18 +1001,22 @@ func escapeNull(b []byte) []byte {
 	return escaped
 }
 
-// unescapeNull unescapes \x01\x01 to \x00 and \x01\x02 to \x01 in place.tabl
-func unescapeNull(escaped []byte) []byte {
+// unescapeNull unescapes \x01\x01 to \x00 and \x01\x02 to \x01 in place.
+// It fails with ErrCorrupt on an invalid escape sequence.
+func unescapeNull(escaped []byte) ([]byte, error) {
 	escapedIdx := 0
 	unescapedIdx := 0
 	for escapedIdx < len(escaped) {
 		if escaped[escapedIdx] == 0x01 {
+			if escapedIdx+1 == len(escaped) {
+				return nil, fmt.Errorf("%w: truncated escape sequence", ErrCorrupt)
+			}
 			if escaped[escapedIdx+1] == 0x01 {
 				escaped[unescapedIdx] = 0
 			} else if escaped[escapedIdx+1] == 0x02 {
 				escaped[unescapedIdx] = 1
 			} else {
-				panic(fmt.Sprintf("invalid escape sequence: %x", escaped[escapedIdx:escapedIdx+2]))
+				return nil, fmt.Errorf("%w: invalid escape sequence: %x", ErrCorrupt, escaped[escapedIdx:escapedIdx+2])
 			}
 			escapedIdx += 2
 			unescapedIdx++
@@ -359,5 +1026,5 @@ func unescapeNull(escaped []byte) []byte {
 			unescapedIdx++
 		}
 	}
-	return escaped[:unescapedIdx]
+	return escaped[:unescapedIdx], nil
 }
@@ -0,0 +1,142 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"iter"
+	"reflect"
+)
+
+// Table is a typed handle on a table whose records are mapped to the struct T, see SchemaOf.
+// The primary keys are given as the values of the primary key fields of T, in their order.
+//
+// Each method runs in its own transaction. The table definition is looked up every time,
+// so the handle stays valid across AlterTable as long as the columns of T are kept.
+type Table[T any] struct {
+	db   *DB
+	name string
+	m    *structMapping
+}
+
+// OpenTable returns a handle on the table, which must exist and hold the columns of T with the same types.
+// The table name overrides the one of T.
+func OpenTable[T any](db *DB, table string) (*Table[T], error) {
+	m, err := mappingOf(reflect.TypeFor[T]())
+	if err != nil {
+		return nil, err
+	}
+	err = db.view(func(tx *Tx) error {
+		_, err := tx.mappedTableDef(table, m)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Table[T]{db: db, name: table, m: m}, nil
+}
+
+// key returns the primary key record of the values of the primary key fields.
+// It fails if they are not of the types of the fields.
+func (m *structMapping) key(pk []any) (AnonymousRecord, error) {
+	ar := make(AnonymousRecord, len(pk))
+	for _, f := range m.fields {
+		if !f.pk {
+			continue
+		}
+		if len(ar) == len(pk) {
+			return nil, fmt.Errorf("expected more than %d primary key values", len(pk))
+		}
+		v := reflect.ValueOf(pk[len(ar)])
+		if !v.IsValid() {
+			return nil, fmt.Errorf("primary key %s is nil", f.col)
+		}
+		if typ, ok := columnType(v.Type()); !ok || typ != f.typ {
+			return nil, fmt.Errorf("primary key %s: expected %s got %T", f.col, f.typ, pk[len(ar)])
+		}
+		ar[f.col] = fieldValue(v, f.typ)
+	}
+	if len(ar) != len(pk) {
+		return nil, fmt.Errorf("expected %d primary key values got %d", len(ar), len(pk))
+	}
+	return ar, nil
+}
+
+// Get returns the record with the primary key, ok is false if there is none.
+func (t *Table[T]) Get(pk ...any) (v T, ok bool, err error) {
+	key, err := t.m.key(pk)
+	if err != nil {
+		return v, false, err
+	}
+	err = t.db.view(func(tx *Tx) (err error) {
+		ok, err = tx.load(t.name, t.m, reflect.ValueOf(&v).Elem(), key)
+		return err
+	})
+	return v, ok, err
+}
+
+// Put inserts or overwrites the record.
+func (t *Table[T]) Put(v T) error {
+	return t.db.update(func(tx *Tx) error {
+		return tx.put(t.name, t.m, reflect.ValueOf(v))
+	})
+}
+
+// Delete deletes the record with the primary key, it returns false if there is none.
+func (t *Table[T]) Delete(pk ...any) (bool, error) {
+	key, err := t.m.key(pk)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	err = t.db.update(func(tx *Tx) (err error) {
+		if _, err := tx.mappedTableDef(t.name, t.m); err != nil {
+			return err
+		}
+		ok, err = tx.Delete(t.name, key)
+		return err
+	})
+	return ok, err
+}
+
+// Range returns the records whose primary key is at least from and less than to, in the primary key order.
+// The records are read from a snapshot taken when the iteration starts, which is released when it ends.
+// An error ends the iteration.
+func (t *Table[T]) Range(from, to []any) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		fromKey, err := t.m.key(from)
+		if err != nil {
+			yield(zero, fmt.Errorf("from: %w", err))
+			return
+		}
+		toKey, err := t.m.key(to)
+		if err != nil {
+			yield(zero, fmt.Errorf("to: %w", err))
+			return
+		}
+		tx := t.db.beginRead()
+		defer tx.Abort()
+		if _, err := tx.mappedTableDef(t.name, t.m); err != nil {
+			yield(zero, err)
+			return
+		}
+		sc, err := tx.Scan(t.name, fromKey, CmpGE, toKey, CmpLT)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		for row, err := range sc.All() {
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			var v T
+			if err := t.m.load(reflect.ValueOf(&v).Elem(), row.Record()); err != nil {
+				yield(zero, err)
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package deadsimpledb
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type tableHandleTestScore struct {
+	Game   string `dsdb:"game,pk"`
+	Player int64  `dsdb:"player,pk"`
+	Points int32  `dsdb:"points"`
+	Note   *string
+}
+
+func TestTable(t *testing.T) {
+	db, err := NewDB(path.Join(t.TempDir(), "table.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	schema, err := SchemaOf(tableHandleTestScore{})
+	require.NoError(t, err)
+	require.NoError(t, db.CreateTable(schema))
+	require.NoError(t, db.RenameTable("tableHandleTestScore", "scores"))
+
+	_, err = OpenTable[tableHandleTestScore](db, "missing")
+	require.Error(t, err)
+	_, err = OpenTable[structTestUser](db, "scores")
+	require.Error(t, err)
+	scores, err := OpenTable[tableHandleTestScore](db, "scores")
+	require.NoError(t, err)
+
+	note := "first"
+	for _, s := range []tableHandleTestScore{
+		{Game: "chess", Player: 2, Points: 10},
+		{Game: "chess", Player: 1, Points: 20, Note: &note},
+		{Game: "go", Player: 1, Points: 30},
+	} {
+		require.NoError(t, scores.Put(s))
+	}
+
+	t.Run("get", func(t *testing.T) {
+		s, ok, err := scores.Get("chess", int64(1))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, tableHandleTestScore{Game: "chess", Player: 1, Points: 20, Note: &note}, s)
+
+		_, ok, err = scores.Get("chess", int64(3))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// the primary key values must match the primary key fields.
+		_, _, err = scores.Get("chess")
+		require.Error(t, err)
+		_, _, err = scores.Get("chess", "1")
+		require.Error(t, err)
+		_, _, err = scores.Get("chess", int64(1), int64(2))
+		require.Error(t, err)
+	})
+
+	t.Run("range", func(t *testing.T) {
+		var got []int32
+		for s, err := range scores.Range([]any{"chess", int64(0)}, []any{"go", int64(1)}) {
+			require.NoError(t, err)
+			got = append(got, s.Points)
+		}
+		require.Equal(t, []int32{20, 10}, got)
+
+		// breaking out of the loop releases the snapshot.
+		for range scores.Range([]any{"a", int64(0)}, []any{"z", int64(0)}) {
+			break
+		}
+		require.Empty(t, db.kv.pager.freeList.pins)
+
+		for _, err := range scores.Range([]any{"a"}, []any{"z", int64(0)}) {
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ok, err := scores.Delete("go", int64(1))
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = scores.Delete("go", int64(1))
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, ok, err = scores.Get("go", int64(1))
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -12,37 +14,69 @@ import (
 func Test_serializeDeserializeValues(t *testing.T) {
 	testCases := []struct {
 		name string
-		r    []value
+		r    []Value
 	}{
 		{
 			name: "Non-null values",
-			r: []value{
-				newBlob([]byte("hello")),
-				newInt64(123),
+			r: []Value{
+				Blob([]byte("hello")),
+				Int64(123),
 			},
 		},
 		{
 			name: "Null values",
-			r: []value{
-				newNullValue(typeBlob),
-				newNullValue(typeInt64),
+			r: []Value{
+				Null(TypeBlob),
+				Null(TypeInt64),
 			},
 		},
 		{
 			name: "Mixed values",
-			r: []value{
-				newBlob([]byte("hello")),
-				newNullValue(typeInt64),
-				newInt64(123),
-				newNullValue(typeBlob),
+			r: []Value{
+				Blob([]byte("hello")),
+				Null(TypeInt64),
+				Int64(123),
+				Null(TypeBlob),
 			},
 		},
 		{
 			name: "int64",
-			r: []value{
-				newInt64(-123),
-				newInt64(-1),
-				newInt64(0),
+			r: []Value{
+				Int64(-123),
+				Int64(-1),
+				Int64(0),
+			},
+		},
+		{
+			name: "Values sharing their encoding with null before",
+			r: []Value{
+				Blob([]byte{}),
+				Int64(math.MinInt64),
+				Null(TypeBlob),
+				Null(TypeInt64),
+				Blob([]byte{0, 1}),
+				Int64(math.MaxInt64),
+				Null(TypeBlob),
+				Null(TypeInt64),
+				Blob([]byte("ninth")),
+			},
+		},
+		{
+			name: "Richer types",
+			r: []Value{
+				Bool(true),
+				Bool(false),
+				Float64(-1.5),
+				Float64(math.Inf(1)),
+				String("héllo"),
+				String(""),
+				Timestamp(time.Date(2024, 2, 29, 12, 30, 0, 123, time.UTC)),
+				UUID([16]byte{0: 0xde, 15: 0xad}),
+				Null(TypeBool),
+				Null(TypeFloat64),
+				Null(TypeString),
+				Null(TypeTimestamp),
+				Null(TypeUUID),
 			},
 		},
 	}
@@ -52,9 +86,9 @@ func Test_serializeDeserializeValues(t *testing.T) {
 			serialized := new(bytes.Buffer)
 			err := serializeValues(serialized, tc.r)
 			require.NoError(t, err, "failed to serialze values")
-			deserialized := make([]value, len(tc.r))
+			deserialized := make([]Value, len(tc.r))
 			for i, v := range tc.r {
-				deserialized[i] = value{Type: v.Type}
+				deserialized[i] = Value{Type: v.Type}
 			}
 			err = deserializeValues(serialized, deserialized)
 			require.NoError(t, err, "failed to deserialze values")
@@ -64,6 +98,110 @@ func Test_serializeDeserializeValues(t *testing.T) {
 
 }
 
+func Test_serializeKey(t *testing.T) {
+	t.Run("round_trip", func(t *testing.T) {
+		vals := []Value{Int64(-123), Blob([]byte("a\x00b")), Int64(1 << 40)}
+		serialized := new(bytes.Buffer)
+		require.NoError(t, serializeKey(serialized, vals))
+		deserialized := []Value{{Type: TypeInt64}, {Type: TypeBlob}, {Type: TypeInt64}}
+		require.NoError(t, deserializeKey(serialized, deserialized))
+		require.Equal(t, vals, deserialized)
+	})
+
+	t.Run("round_trip_richer_types", func(t *testing.T) {
+		vals := []Value{
+			Bool(true),
+			Float64(-0.25),
+			String("a\x00é"),
+			Timestamp(time.Date(1969, 7, 20, 20, 17, 0, 1, time.UTC)),
+			UUID([16]byte{1, 2, 3, 15: 0xff}),
+		}
+		serialized := new(bytes.Buffer)
+		require.NoError(t, serializeKey(serialized, vals))
+		deserialized := []Value{{Type: TypeBool}, {Type: TypeFloat64}, {Type: TypeString}, {Type: TypeTimestamp}, {Type: TypeUUID}}
+		require.NoError(t, deserializeKey(serialized, deserialized))
+		require.Equal(t, vals, deserialized)
+	})
+
+	t.Run("order", func(t *testing.T) {
+		ordered := [][]Value{
+			{Int64(math.MinInt64), Blob([]byte("z"))},
+			{Int64(-256), Blob([]byte("a"))},
+			{Int64(-1), Blob([]byte("a"))},
+			{Int64(0), Blob([]byte("a"))},
+			{Int64(1), Blob([]byte("a"))},
+			{Int64(1), Blob([]byte("a\x00"))},
+			{Int64(1), Blob([]byte("b"))},
+			{Int64(255), Blob([]byte("a"))},
+			{Int64(256), Blob([]byte("a"))},
+			{Int64(math.MaxInt64), Blob([]byte("a"))},
+		}
+		var prev []byte
+		for _, vals := range ordered {
+			key := new(bytes.Buffer)
+			require.NoError(t, serializeKey(key, vals))
+			require.Negativef(t, bytes.Compare(prev, key.Bytes()), "%v is not ordered after the previous key", vals)
+			prev = key.Bytes()
+		}
+	})
+
+	t.Run("order_richer_types", func(t *testing.T) {
+		epoch := time.Unix(0, 0)
+		ordered := [][]Value{
+			{Bool(false), Float64(math.Inf(1))},
+			{Bool(true), Float64(math.Inf(-1))},
+			{Bool(true), Float64(-math.MaxFloat64)},
+			{Bool(true), Float64(-1)},
+			{Bool(true), Float64(-math.SmallestNonzeroFloat64)},
+			{Bool(true), Float64(0)},
+			{Bool(true), Float64(math.SmallestNonzeroFloat64)},
+			{Bool(true), Float64(0.5)},
+			{Bool(true), Float64(1)},
+			{Bool(true), Float64(math.MaxFloat64)},
+			{Bool(true), Float64(math.Inf(1))},
+		}
+		ordered2 := [][]Value{
+			{Timestamp(epoch.Add(-time.Hour)), String("z"), UUID([16]byte{})},
+			{Timestamp(epoch.Add(-1)), String("z"), UUID([16]byte{})},
+			{Timestamp(epoch), String(""), UUID([16]byte{})},
+			{Timestamp(epoch), String("a"), UUID([16]byte{15: 1})},
+			{Timestamp(epoch), String("a"), UUID([16]byte{0: 1})},
+			{Timestamp(epoch), String("é"), UUID([16]byte{})},
+			{Timestamp(epoch.Add(1)), String(""), UUID([16]byte{})},
+		}
+		for _, ordered := range [][][]Value{ordered, ordered2} {
+			var prev []byte
+			for _, vals := range ordered {
+				key := new(bytes.Buffer)
+				require.NoError(t, serializeKey(key, vals))
+				require.Negativef(t, bytes.Compare(prev, key.Bytes()), "%v is not ordered after the previous key", vals)
+				prev = key.Bytes()
+			}
+		}
+	})
+}
+
+func Test_serializeNullableKey(t *testing.T) {
+	ordered := []Value{Null(TypeInt64), Int64(math.MinInt64), Int64(0)}
+	var prev []byte
+	for _, v := range ordered {
+		key := new(bytes.Buffer)
+		require.NoError(t, serializeNullableKey(key, v))
+		require.Negativef(t, bytes.Compare(prev, key.Bytes()), "%v is not ordered after the previous key", v)
+		prev = key.Bytes()
+
+		got := Value{Type: v.Type}
+		require.NoError(t, deserializeNullableKey(key, &got))
+		require.Equal(t, v, got)
+	}
+
+	blob := new(bytes.Buffer)
+	require.NoError(t, serializeNullableKey(blob, Blob([]byte{})))
+	got := Value{Type: TypeBlob}
+	require.NoError(t, deserializeNullableKey(blob, &got))
+	require.Equal(t, Blob([]byte{}), got)
+}
+
 var nullEscapeTestCases = []struct {
 	unescape []byte
 	escaped  []byte
@@ -99,10 +237,18 @@ func Test_escapeNull(t *testing.T) {
 func Test_unescapeNull(t *testing.T) {
 	for i, tc := range nullEscapeTestCases {
 		t.Run(fmt.Sprintf("testcase_%d", i+1), func(t *testing.T) {
-			out := unescapeNull(tc.escaped)
+			out, err := unescapeNull(tc.escaped)
+			require.NoError(t, err)
 			require.Equal(t, tc.unescape, out, "unescaped bytes not match")
 		})
 	}
+
+	for _, escaped := range [][]byte{{0x01, 0x03}, {0x02, 0x01}} {
+		t.Run(fmt.Sprintf("invalid_%x", escaped), func(t *testing.T) {
+			_, err := unescapeNull(escaped)
+			require.ErrorIs(t, err, ErrCorrupt)
+		})
+	}
 }
 
 func Test_readNullTerminatedBlob(t *testing.T) {
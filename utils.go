@@ -1,9 +1,32 @@
 package deadsimpledb
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 func assert(v bool, s string, args ...interface{}) {
 	if !v {
 		panic(fmt.Sprintf(s, args...))
 	}
 }
+
+// corrupted panics with an error wrapping ErrCorrupt. It is used by the checks on the data read from the file
+// that are too deep in the tree to return an error, recoverPanic turns it back into the error.
+func corrupted(format string, args ...interface{}) {
+	panic(fmt.Errorf("%w: %s", ErrCorrupt, fmt.Sprintf(format, args...)))
+}
+
+// recoverPanic turns a panic back into an error at the public entry points.
+// A corrupted page, or any other error wrapping ErrCorrupt, is returned as is.
+// Any other panic is an assertion or a runtime error, meaning the in-memory state is not what it is expected to be,
+// and is reported as ErrInternal rather than blaming the file.
+func recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(error); ok && errors.Is(e, ErrCorrupt) {
+			*err = e
+			return
+		}
+		*err = fmt.Errorf("%w: %v", ErrInternal, r)
+	}
+}
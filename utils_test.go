@@ -0,0 +1,43 @@
+package deadsimpledb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	recovered := func(fn func()) (err error) {
+		defer recoverPanic(&err)
+		fn()
+		return nil
+	}
+
+	t.Run("corrupt_page", func(t *testing.T) {
+		err := recovered(func() { Page{ptr: 3, inner: make([]byte, PageSize)}.asFreeList() })
+		var corrupt *ErrCorruptPage
+		require.ErrorAs(t, err, &corrupt)
+		require.ErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		err := recovered(func() { corrupted("invalid ptr: %x", 42) })
+		require.ErrorIs(t, err, ErrCorrupt)
+		require.NotErrorIs(t, err, ErrInternal)
+	})
+
+	t.Run("assert", func(t *testing.T) {
+		err := recovered(func() { assert(false, "%d out of bound", 1) })
+		require.ErrorIs(t, err, ErrInternal)
+		require.NotErrorIs(t, err, ErrCorrupt)
+	})
+
+	t.Run("runtime_error", func(t *testing.T) {
+		err := recovered(func() {
+			var node *BtreeNode
+			node.getNkeys()
+		})
+		require.ErrorIs(t, err, ErrInternal)
+		require.NotErrorIs(t, err, ErrCorrupt)
+	})
+}
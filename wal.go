@@ -0,0 +1,171 @@
+package deadsimpledb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Write-ahead log layout
+// The log is a sequence of records, one per commit.
+// | npages | root | flushed | free list | ptr | page     | ... | checksum |
+// | 4B     | 8B   | 8B      | 8B        | 8B  | PageSize | ... | 4B       |
+//
+// npages is the number of (ptr, page) pairs in the record.
+// checksum is the CRC32 (Castagnoli) of everything before it in the record.
+// A record that is cut short or fails its checksum is the commit that was being appended when the process crashed,
+// it marks the end of the log and is discarded on replay.
+
+const (
+	walRecordHeaderSize = 4 + 8 + 8 + 8
+	walChecksumSize     = 4
+	// defaultCheckpointPages is the number of logged pages after which the log is checkpointed.
+	defaultCheckpointPages = 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type wal struct {
+	file *os.File
+	// size is the size of the valid part of the log.
+	size int64
+	// npages is the number of pages in the log.
+	npages int
+	// readOnly opens the log without write access, it can only be replayed.
+	readOnly bool
+}
+
+func walPath(path string) string {
+	return path + "-wal"
+}
+
+func openWal(path string, readOnly bool) (*wal, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile: %w", err)
+	}
+	return &wal{file: f, readOnly: readOnly}, nil
+}
+
+// append writes a record holding the pages and the header they are committed with and fsyncs the log.
+func (w *wal) append(header Header, pages []Page) error {
+	rec := make([]byte, walRecordHeaderSize+len(pages)*(8+PageSize)+walChecksumSize)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(pages)))
+	binary.LittleEndian.PutUint64(rec[4:], header.root)
+	binary.LittleEndian.PutUint64(rec[12:], header.flushed)
+	binary.LittleEndian.PutUint64(rec[20:], header.freeList)
+	pos := walRecordHeaderSize
+	for _, page := range pages {
+		binary.LittleEndian.PutUint64(rec[pos:], page.ptr)
+		// pages can be shorter than PageSize, the remaining is left zeroed.
+		copy(rec[pos+8:pos+8+PageSize], page.inner)
+		pos += 8 + PageSize
+	}
+	binary.LittleEndian.PutUint32(rec[pos:], crc32.Checksum(rec[:pos], castagnoli))
+
+	if _, err := w.file.WriteAt(rec, w.size); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	w.size += int64(len(rec))
+	w.npages += len(pages)
+	return nil
+}
+
+// replay calls fn with every complete record in the log, in the order they were appended.
+// The log is truncated after the last complete record, unless it is read-only.
+func (w *wal) replay(fn func(header Header, pages []Page)) error {
+	w.size = 0
+	w.npages = 0
+	for {
+		header, pages, n, err := w.readRecord(w.size)
+		if errors.Is(err, errTornRecord) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		fn(header, pages)
+		w.size += n
+		w.npages += len(pages)
+	}
+	if w.readOnly {
+		return nil
+	}
+	if err := w.file.Truncate(w.size); err != nil {
+		return fmt.Errorf("truncating torn record: %w", err)
+	}
+	return nil
+}
+
+var errTornRecord = errors.New("torn log record")
+
+func (w *wal) readRecord(off int64) (Header, []Page, int64, error) {
+	head := make([]byte, walRecordHeaderSize)
+	if _, err := w.file.ReadAt(head, off); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Header{}, nil, 0, errTornRecord
+		}
+		return Header{}, nil, 0, err
+	}
+	npages := int(binary.LittleEndian.Uint32(head))
+	stat, err := w.file.Stat()
+	if err != nil {
+		return Header{}, nil, 0, fmt.Errorf("os.File.Stat: %w", err)
+	}
+	size := int64(walRecordHeaderSize + npages*(8+PageSize) + walChecksumSize)
+	if off+size > stat.Size() {
+		return Header{}, nil, 0, errTornRecord
+	}
+
+	rec := make([]byte, size)
+	if _, err := w.file.ReadAt(rec, off); err != nil {
+		return Header{}, nil, 0, err
+	}
+	end := len(rec) - walChecksumSize
+	if crc32.Checksum(rec[:end], castagnoli) != binary.LittleEndian.Uint32(rec[end:]) {
+		return Header{}, nil, 0, errTornRecord
+	}
+
+	header := Header{
+		root:     binary.LittleEndian.Uint64(rec[4:]),
+		flushed:  binary.LittleEndian.Uint64(rec[12:]),
+		freeList: binary.LittleEndian.Uint64(rec[20:]),
+	}
+	pages := make([]Page, npages)
+	pos := walRecordHeaderSize
+	for i := range pages {
+		pages[i] = Page{
+			ptr:   binary.LittleEndian.Uint64(rec[pos:]),
+			inner: rec[pos+8 : pos+8+PageSize],
+		}
+		pos += 8 + PageSize
+	}
+	return header, pages, size, nil
+}
+
+// reset discards every record once they have been checkpointed.
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	w.size = 0
+	w.npages = 0
+	return nil
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,149 @@
+package deadsimpledb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// crashKV closes the KV without checkpointing the log, as if the process was killed.
+func crashKV(t *testing.T, kv *KV) {
+	require.NoError(t, kv.wal.close())
+	require.NoError(t, kv.pager.close())
+	require.NoError(t, kv.file.Close())
+}
+
+func walKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%04d", i))
+}
+
+func requireKeys(t *testing.T, kv *KV, from, to int, exist bool) {
+	for i := from; i < to; i++ {
+		val, ok, err := kv.Get(walKey(i))
+		require.NoError(t, err)
+		require.Equalf(t, exist, ok, "key %d", i)
+		if exist {
+			require.Equal(t, makeData(fmt.Sprintf("val-%d-", i), 128), val)
+		}
+	}
+}
+
+func TestWAL(t *testing.T) {
+	setup := func(t *testing.T, opts OpenOptions) (*KV, string) {
+		dbPath := filepath.Join(t.TempDir(), "wal.db")
+		kv, err := NewKVWithOptions(dbPath, opts)
+		require.NoError(t, err)
+		return kv, dbPath
+	}
+	set := func(t *testing.T, kv *KV, from, to int) {
+		for i := from; i < to; i++ {
+			require.NoError(t, kv.Set(walKey(i), makeData(fmt.Sprintf("val-%d-", i), 128)))
+		}
+	}
+
+	t.Run("recover_after_crash", func(t *testing.T) {
+		kv, dbPath := setup(t, OpenOptions{WAL: true})
+		set(t, kv, 0, 100)
+		_, err := kv.Del(walKey(0))
+		require.NoError(t, err)
+		requireKeys(t, kv, 1, 100, true)
+
+		// nothing has been checkpointed yet
+		stat, err := os.Stat(dbPath)
+		require.NoError(t, err)
+		require.Zero(t, stat.Size())
+		crashKV(t, kv)
+
+		kv, err = NewKVWithOptions(dbPath, OpenOptions{WAL: true})
+		require.NoError(t, err)
+		requireKeys(t, kv, 0, 1, false)
+		requireKeys(t, kv, 1, 100, true)
+		// the log is checkpointed on open
+		require.Zero(t, kv.wal.size)
+
+		set(t, kv, 100, 150)
+		require.NoError(t, kv.Close())
+
+		kv, err = NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		requireKeys(t, kv, 1, 150, true)
+	})
+
+	t.Run("torn_record", func(t *testing.T) {
+		kv, dbPath := setup(t, OpenOptions{WAL: true})
+		set(t, kv, 0, 10)
+		size := kv.wal.size
+		set(t, kv, 10, 11)
+		crashKV(t, kv)
+
+		// cut the last commit short as if the crash happened while appending it
+		require.NoError(t, os.Truncate(walPath(dbPath), size+int64(PageSize)))
+
+		kv, err := NewKVWithOptions(dbPath, OpenOptions{WAL: true})
+		require.NoError(t, err)
+		defer kv.Close()
+		requireKeys(t, kv, 0, 10, true)
+		requireKeys(t, kv, 10, 11, false)
+		set(t, kv, 10, 20)
+		requireKeys(t, kv, 0, 20, true)
+	})
+
+	t.Run("corrupted_record", func(t *testing.T) {
+		kv, dbPath := setup(t, OpenOptions{WAL: true})
+		set(t, kv, 0, 10)
+		size := kv.wal.size
+		set(t, kv, 10, 11)
+		crashKV(t, kv)
+
+		f, err := os.OpenFile(walPath(dbPath), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{0xff, 0xff}, size+walRecordHeaderSize+16)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		kv, err = NewKVWithOptions(dbPath, OpenOptions{WAL: true})
+		require.NoError(t, err)
+		defer kv.Close()
+		requireKeys(t, kv, 0, 10, true)
+		requireKeys(t, kv, 10, 11, false)
+	})
+
+	t.Run("checkpoint", func(t *testing.T) {
+		kv, dbPath := setup(t, OpenOptions{WAL: true, CheckpointPages: 8})
+		set(t, kv, 0, 100)
+		require.Less(t, kv.wal.npages, 8)
+		crashKV(t, kv)
+
+		// the log is replayed without WAL mode too, and removed afterward
+		kv, err := NewKV(dbPath)
+		require.NoError(t, err)
+		defer kv.Close()
+		requireKeys(t, kv, 0, 100, true)
+		_, err = os.Stat(walPath(dbPath))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		kv, dbPath := setup(t, OpenOptions{WAL: true})
+		set(t, kv, 0, 50)
+
+		tx := kv.Begin()
+		for i := 0; i < 50; i++ {
+			_, err := tx.Del(walKey(i))
+			require.NoError(t, err)
+		}
+		tx.Abort()
+		requireKeys(t, kv, 0, 50, true)
+		set(t, kv, 50, 60)
+		crashKV(t, kv)
+
+		kv, err := NewKVWithOptions(dbPath, OpenOptions{WAL: true})
+		require.NoError(t, err)
+		defer kv.Close()
+		requireKeys(t, kv, 0, 60, true)
+	})
+}